@@ -0,0 +1,252 @@
+package pcap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits bounds a Capture. Zero fields are unlimited. Bytes counts
+// Packet.Len. Idle is the longest gap allowed between two packets.
+type Limits struct {
+	Packets  uint64
+	Bytes    uint64
+	Duration time.Duration
+	Idle     time.Duration
+}
+
+// StopReason tells why a Capture returned.
+type StopReason int
+
+const (
+	StopEOF      StopReason = iota // no more packets
+	StopPackets                    // Limits.Packets reached
+	StopBytes                      // Limits.Bytes reached
+	StopDuration                   // Limits.Duration elapsed
+	StopIdle                       // no packet for Limits.Idle
+	StopContext                    // the context was done
+	StopCallback                   // the callback returned an error
+	StopError                      // reading failed
+)
+
+var stopReasons = []string{"eof", "packets", "bytes", "duration", "idle", "context", "callback", "error"}
+
+func (r StopReason) String() string {
+	if int(r) < len(stopReasons) {
+		return stopReasons[r]
+	}
+	return "unknown"
+}
+
+// ErrStopCapture can be returned by a Capture callback to end the capture
+// without an error.
+var ErrStopCapture = errors.New("pcap: stop capture")
+
+// CaptureSummary describes a finished Capture.
+type CaptureSummary struct {
+	Packets uint64
+	Bytes   uint64
+	First   time.Time // timestamp of the first packet
+	Last    time.Time // timestamp of the last packet
+	Reason  StopReason
+}
+
+// limiter applies Limits to a stream of packets. Durations are measured
+// with the clock passed to it.
+type limiter struct {
+	l     Limits
+	sum   CaptureSummary
+	start time.Time
+	last  time.Time
+}
+
+// stopBefore checks the time limits at now, before a packet is delivered.
+func (s *limiter) stopBefore(now time.Time) bool {
+	switch {
+	case s.l.Duration > 0 && now.Sub(s.start) >= s.l.Duration:
+		s.sum.Reason = StopDuration
+	case s.l.Idle > 0 && now.Sub(s.last) >= s.l.Idle:
+		s.sum.Reason = StopIdle
+	default:
+		return false
+	}
+	return true
+}
+
+// add counts a delivered packet and checks the count limits.
+func (s *limiter) add(pkt *Packet, now time.Time) bool {
+	s.sum.Packets++
+	s.sum.Bytes += uint64(pkt.Len)
+	if s.sum.First.IsZero() {
+		s.sum.First = pkt.Time
+	}
+	s.sum.Last = pkt.Time
+	s.last = now
+	switch {
+	case s.l.Packets > 0 && s.sum.Packets >= s.l.Packets:
+		s.sum.Reason = StopPackets
+	case s.l.Bytes > 0 && s.sum.Bytes >= s.l.Bytes:
+		s.sum.Reason = StopBytes
+	default:
+		return false
+	}
+	return true
+}
+
+// callback runs fn and records a callback stop.
+func (s *limiter) callback(fn func(*Packet) error, pkt *Packet) (bool, error) {
+	err := fn(pkt)
+	if err == nil {
+		return false, nil
+	}
+	s.sum.Reason = StopCallback
+	if err == ErrStopCapture {
+		err = nil
+	}
+	return true, err
+}
+
+// Capture reads packets from h, such as a live or offline Pcap or a
+// RemoteClient, and passes them to fn until a limit is reached, ctx is
+// done, fn returns an error, or the handle reports an error or end of
+// file. Durations are wall-clock time. The packet passed to fn is reused;
+// Clone it to keep it.
+//
+// A watcher goroutine interrupts a blocked read with BreakLoop when ctx or
+// a time limit expires, so handles without a read timeout work too.
+func Capture(ctx context.Context, h Handle, l Limits, fn func(*Packet) error) (CaptureSummary, error) {
+	// An offline Pcap returns 0 at the end of the file.
+	offline := false
+	if p, ok := h.(*Pcap); ok {
+		offline = p.offline
+	}
+	now := time.Now()
+	s := &limiter{l: l, start: now, last: now}
+	lastNano := now.UnixNano()
+	var broke int32
+
+	// The watcher is joined before returning, so it cannot break a handle
+	// the caller closes, and a break NextEx did not report is withdrawn.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		wg.Wait()
+		if c, ok := h.(interface{ cancelBreak() }); ok && atomic.LoadInt32(&broke) != 0 {
+			c.cancelBreak()
+		}
+	}()
+	if l.Duration > 0 || l.Idle > 0 || ctx.Done() != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tick := time.NewTicker(watchInterval(l))
+			defer tick.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ctx.Done():
+				case t := <-tick.C:
+					idle := t.Sub(time.Unix(0, atomic.LoadInt64(&lastNano)))
+					if !(l.Duration > 0 && t.Sub(s.start) >= l.Duration) && !(l.Idle > 0 && idle >= l.Idle) {
+						continue
+					}
+				}
+				atomic.StoreInt32(&broke, 1)
+				h.BreakLoop()
+				return
+			}
+		}()
+	}
+
+	var pkt *Packet
+	for {
+		if ctx.Err() != nil {
+			s.sum.Reason = StopContext
+			return s.sum, ctx.Err()
+		}
+		if s.stopBefore(time.Now()) {
+			return s.sum, nil
+		}
+		var r int32
+		pkt, r = h.NextEx(pkt)
+		switch {
+		case r > 0:
+		case r == 0 && !offline:
+			continue
+		case r == -2 && atomic.LoadInt32(&broke) != 0:
+			// Interrupted by the watcher, the checks above will tell why.
+			atomic.StoreInt32(&broke, 0)
+			continue
+		case r == -1:
+			s.sum.Reason = StopError
+			return s.sum, h.Geterror()
+		default:
+			s.sum.Reason = StopEOF
+			return s.sum, nil
+		}
+		now := time.Now()
+		atomic.StoreInt64(&lastNano, now.UnixNano())
+		limit := s.add(pkt, now)
+		if stop, err := s.callback(fn, pkt); stop || limit {
+			return s.sum, err
+		}
+	}
+}
+
+// Capture reads packets from p and passes them to fn until a limit is
+// reached, ctx is done, fn returns an error, or p reports an error or end
+// of file, as described for the function Capture.
+func (p *Pcap) Capture(ctx context.Context, l Limits, fn func(*Packet) error) (CaptureSummary, error) {
+	return Capture(ctx, p, l, fn)
+}
+
+func watchInterval(l Limits) time.Duration {
+	d := 100 * time.Millisecond
+	for _, v := range []time.Duration{l.Duration / 4, l.Idle / 4} {
+		if v > 0 && v < d {
+			d = v
+		}
+	}
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return d
+}
+
+// Capture reads packets from the file and passes them to fn until a limit
+// is reached, ctx is done, fn returns an error or the file ends or fails to
+// parse. Durations are measured between packet timestamps, so the same
+// limits select the same packets on every run. The packet that crosses a
+// time limit has been read but is not passed to fn.
+func (r *Reader) Capture(ctx context.Context, l Limits, fn func(*Packet) error) (CaptureSummary, error) {
+	s := &limiter{l: l}
+	for {
+		if ctx.Err() != nil {
+			s.sum.Reason = StopContext
+			return s.sum, ctx.Err()
+		}
+		pkt := r.Next()
+		if pkt == nil {
+			if err := r.Err(); err != nil {
+				s.sum.Reason = StopError
+				return s.sum, err
+			}
+			s.sum.Reason = StopEOF
+			return s.sum, nil
+		}
+		if s.start.IsZero() {
+			s.start, s.last = pkt.Time, pkt.Time
+		}
+		if s.stopBefore(pkt.Time) {
+			return s.sum, nil
+		}
+		limit := s.add(pkt, pkt.Time)
+		if stop, err := s.callback(fn, pkt); stop || limit {
+			return s.sum, err
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReaderCaptureLimits(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, &FileHeader{MagicNumber: TCPDUMP_MAGIC, VersionMajor: 2, VersionMinor: 4, SnapLen: 65535, LinkType: LINKTYPE_ETHERNET})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		w.Write(udpPacket(start.Add(time.Duration(i)*time.Second), 1, 2, 1, 2, nil))
+	}
+	// A gap of a minute before the last packet.
+	w.Write(udpPacket(start.Add(70*time.Second), 1, 2, 1, 2, nil))
+
+	for _, tc := range []struct {
+		limits  Limits
+		packets uint64
+		reason  StopReason
+	}{
+		{Limits{}, 11, StopEOF},
+		{Limits{Packets: 3}, 3, StopPackets},
+		{Limits{Bytes: 42 * 4}, 4, StopBytes},
+		{Limits{Duration: 5 * time.Second}, 5, StopDuration},
+		{Limits{Idle: 30 * time.Second}, 10, StopIdle},
+	} {
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := uint64(0)
+		sum, err := r.Capture(context.Background(), tc.limits, func(*Packet) error { n++; return nil })
+		if err != nil || sum.Packets != tc.packets || n != tc.packets || sum.Reason != tc.reason {
+			t.Fatalf("%+v: got %+v (callbacks %d, err %v)", tc.limits, sum, n, err)
+		}
+		if !sum.First.Equal(start) {
+			t.Fatalf("%+v: first packet at %s", tc.limits, sum.First)
+		}
+	}
+}
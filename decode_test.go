@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestDecodeSimpleDns(t *testing.T) {
@@ -275,3 +276,29 @@ func BenchmarkDecode1(b *testing.B) {
 		p.Decode()
 	}
 }
+
+func TestDecodeLinuxSll(t *testing.T) {
+	eth := udpPacket(time.Unix(1, 0), 1, 2, 1000, 53, nil)
+	sll := make([]byte, 16, 16+len(eth.Data)-14)
+	sll[14], sll[15] = 0x08, 0x00
+	p := &Packet{LinkType: LINKTYPE_LINUX_SLL, Data: append(sll, eth.Data[14:]...)}
+	p.Decode()
+	if p.Headers_cnt != 2 {
+		t.Fatalf("Incorrect number of headers %d", p.Headers_cnt)
+	}
+	if udp, ok := p.Headers[1].(*Udphdr); !ok || udp.DestPort != 53 {
+		t.Fatalf("Bad UDP header %+v", p.Headers[1])
+	}
+}
+
+func TestDecodeRawIp6(t *testing.T) {
+	data := make([]byte, 48)
+	data[0] = 0x60
+	data[6] = IP_UDP
+	data[40+3] = 53
+	p := &Packet{LinkType: LINKTYPE_RAW, Data: data}
+	p.Decode()
+	if p.Type != TYPE_IP6 || p.Headers_cnt != 2 {
+		t.Fatalf("Raw IPv6 decoded as type %x with %d headers", p.Type, p.Headers_cnt)
+	}
+}
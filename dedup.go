@@ -0,0 +1,171 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// DedupConfig configures a Deduper. A packet is a duplicate when the hashed
+// part of its data matches a packet seen less than Window earlier, by packet
+// timestamp. Offset and Length select the hashed bytes after the Ignore
+// options have been applied; a zero Length hashes to the end of the packet.
+//
+// Routers decrement the TTL and so rewrite the IPv4 checksum; set both
+// IgnoreTTL and IgnoreChecksum to match copies taken on both sides of a hop.
+type DedupConfig struct {
+	Window time.Duration // defaults to one second
+	Offset int
+	Length int
+
+	IgnoreTTL      bool // IPv4 TTL and IPv6 hop limit
+	IgnoreChecksum bool // IPv4 header checksum
+	IgnoreVLAN     bool // 802.1Q and 802.1ad tags
+}
+
+// DedupStats counts the packets seen and suppressed by a Deduper.
+type DedupStats struct {
+	Seen       uint64
+	Duplicates uint64
+	Tracked    int // hashes currently remembered
+}
+
+// Deduper wraps a PacketSource and drops repeated frames, like editcap -d
+// on a stream.
+type Deduper struct {
+	src PacketSource
+	cfg DedupConfig
+	buf []byte
+
+	mu    sync.Mutex
+	seen  map[uint64]time.Time
+	fifo  []dedupEntry
+	stats DedupStats
+}
+
+type dedupEntry struct {
+	hash uint64
+	ts   time.Time
+}
+
+// NewDeduper returns a Deduper reading from src. src may be nil if only
+// Duplicate is used.
+func NewDeduper(src PacketSource, cfg DedupConfig) *Deduper {
+	if cfg.Window <= 0 {
+		cfg.Window = time.Second
+	}
+	return &Deduper{
+		src:  src,
+		cfg:  cfg,
+		seen: make(map[uint64]time.Time),
+	}
+}
+
+// Next returns the next packet that is not a duplicate, or nil when the
+// source returns nil.
+func (d *Deduper) Next() *Packet {
+	for {
+		pkt := d.src.Next()
+		if pkt == nil {
+			return nil
+		}
+		if !d.Duplicate(pkt) {
+			return pkt
+		}
+	}
+}
+
+// Duplicate reports whether pkt repeats a packet seen within the window and
+// remembers it otherwise.
+func (d *Deduper) Duplicate(pkt *Packet) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stats.Seen++
+	d.expire(pkt.Time)
+	h := d.hash(pkt)
+	if ts, ok := d.seen[h]; ok && pkt.Time.Sub(ts) < d.cfg.Window {
+		d.stats.Duplicates++
+		return true
+	}
+	d.seen[h] = pkt.Time
+	d.fifo = append(d.fifo, dedupEntry{h, pkt.Time})
+	return false
+}
+
+// Stats returns a snapshot of the dedup counters.
+func (d *Deduper) Stats() DedupStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := d.stats
+	st.Tracked = len(d.seen)
+	return st
+}
+
+func (d *Deduper) expire(now time.Time) {
+	n := 0
+	for ; n < len(d.fifo); n++ {
+		e := d.fifo[n]
+		if now.Sub(e.ts) < d.cfg.Window {
+			break
+		}
+		if ts, ok := d.seen[e.hash]; ok && ts.Equal(e.ts) {
+			delete(d.seen, e.hash)
+		}
+	}
+	if n > 0 {
+		d.fifo = append(d.fifo[:0], d.fifo[n:]...)
+	}
+}
+
+// hash normalizes a copy of the packet data as configured and hashes the
+// selected range.
+func (d *Deduper) hash(pkt *Packet) uint64 {
+	data := pkt.Data
+	etherType, nh, ok := linkPayload(pkt)
+	l3 := len(data) - len(nh)
+	switch {
+	case !ok:
+		d.buf = append(d.buf[:0], data...)
+	case d.cfg.IgnoreVLAN && l3 > 14 && pkt.LinkType != LINKTYPE_LINUX_SLL:
+		d.buf = append(d.buf[:0], data[:12]...)
+		d.buf = append(d.buf, byte(etherType>>8), byte(etherType))
+		d.buf = append(d.buf, nh...)
+		l3 = 14
+	default:
+		d.buf = append(d.buf[:0], data...)
+	}
+	buf := d.buf
+	if ok {
+		ip := buf[l3:]
+		switch {
+		case etherType == TYPE_IP && len(ip) >= 20:
+			if d.cfg.IgnoreTTL {
+				ip[8] = 0
+			}
+			if d.cfg.IgnoreChecksum {
+				ip[10], ip[11] = 0, 0
+			}
+		case etherType == TYPE_IP6 && len(ip) >= 40:
+			if d.cfg.IgnoreTTL {
+				ip[7] = 0
+			}
+		}
+	}
+
+	if d.cfg.Offset >= len(buf) {
+		buf = nil
+	} else if d.cfg.Offset > 0 {
+		buf = buf[d.cfg.Offset:]
+	}
+	if d.cfg.Length > 0 && d.cfg.Length < len(buf) {
+		buf = buf[:d.cfg.Length]
+	}
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(buf)))
+	h := fnv.New64a()
+	h.Write(n[:])
+	h.Write(buf)
+	return h.Sum64()
+}
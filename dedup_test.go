@@ -0,0 +1,58 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func vlanTag(pkt *Packet, vid uint16) *Packet {
+	data := make([]byte, 0, len(pkt.Data)+4)
+	data = append(data, pkt.Data[:12]...)
+	data = append(data, 0x81, 0x00, byte(vid>>8), byte(vid))
+	data = append(data, pkt.Data[12:]...)
+	tagged := *pkt
+	tagged.Data = data
+	tagged.Caplen += 4
+	tagged.Len += 4
+	return &tagged
+}
+
+func TestDedupWindow(t *testing.T) {
+	start := time.Unix(1000, 0)
+	src := sliceSource{
+		udpPacket(start, 1, 2, 1, 2, []byte("a")),
+		udpPacket(start.Add(time.Millisecond), 1, 2, 1, 2, []byte("a")),
+		udpPacket(start.Add(2*time.Millisecond), 1, 2, 1, 2, []byte("b")),
+		udpPacket(start.Add(2*time.Second), 1, 2, 1, 2, []byte("a")),
+	}
+	d := NewDeduper(&src, DedupConfig{Window: time.Second})
+	n := 0
+	for pkt := d.Next(); pkt != nil; pkt = d.Next() {
+		n++
+	}
+	if st := d.Stats(); n != 3 || st.Duplicates != 1 || st.Seen != 4 {
+		t.Fatalf("passed %d, stats %+v", n, st)
+	}
+}
+
+func TestDedupIgnore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	orig := udpPacket(now, 1, 2, 1, 2, []byte("x"))
+	hop := udpPacket(now, 1, 2, 1, 2, []byte("x"))
+	hop.Data[14+8]--
+	binary.BigEndian.PutUint16(hop.Data[14+10:], 0xbeef)
+	tagged := vlanTag(orig, 10)
+
+	strict := NewDeduper(nil, DedupConfig{})
+	strict.Duplicate(orig)
+	if strict.Duplicate(hop) || strict.Duplicate(tagged) {
+		t.Fatal("strict dedup matched modified frames")
+	}
+
+	loose := NewDeduper(nil, DedupConfig{IgnoreTTL: true, IgnoreChecksum: true, IgnoreVLAN: true})
+	loose.Duplicate(orig)
+	if !loose.Duplicate(hop) || !loose.Duplicate(tagged) {
+		t.Fatal("loose dedup missed modified frames")
+	}
+}
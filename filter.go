@@ -0,0 +1,85 @@
+package pcap
+
+import (
+	"time"
+)
+
+// FilterSwap selects what ReplaceFilter does with packets that were
+// buffered under the previous filter but not yet returned by NextEx.
+type FilterSwap int
+
+const (
+	SwapMark  FilterSwap = iota // deliver them tagged with the old generation
+	SwapDrain                   // discard them
+)
+
+// FilterStat counts the packets a Pcap handle delivered while one filter
+// generation was installed. Generation 0 is the handle before any filter.
+type FilterStat struct {
+	Gen       uint32
+	Filter    string
+	Installed time.Time
+	Replaced  time.Time // zero while the filter is still installed
+	Packets   uint64
+	Bytes     uint64 // sum of Packet.Len
+	Discarded uint64 // buffered packets dropped by SwapDrain
+}
+
+// FilterGen returns the generation of the currently installed filter.
+func (p *Pcap) FilterGen() uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.gen
+}
+
+// FilterStats returns a copy of the per-generation counters, oldest first.
+func (p *Pcap) FilterStats() []FilterStat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make([]FilterStat, len(p.filters))
+	for i, f := range p.filters {
+		stats[i] = *f
+	}
+	return stats
+}
+
+func (p *Pcap) resetFilterGen() {
+	p.gen = 0
+	p.bufGen = 0
+	p.filters = []*FilterStat{{Installed: time.Now()}}
+}
+
+// newFilterGen records expr as the installed filter. p.mu must be held.
+func (p *Pcap) newFilterGen(expr string) uint32 {
+	now := time.Now()
+	if cur := p.filterStat(p.gen); cur != nil {
+		cur.Replaced = now
+	}
+	p.gen++
+	p.filters = append(p.filters, &FilterStat{Gen: p.gen, Filter: expr, Installed: now})
+	return p.gen
+}
+
+func (p *Pcap) filterStat(gen uint32) *FilterStat {
+	if int(gen) < len(p.filters) {
+		return p.filters[gen]
+	}
+	return nil
+}
+
+// account adds pkt to the counters of its filter generation. p.mu must be held.
+func (p *Pcap) account(pkt *Packet) {
+	if f := p.filterStat(pkt.FilterGen); f != nil {
+		f.Packets++
+		f.Bytes += uint64(pkt.Len)
+	}
+}
+
+// discardBuffered drops the packets NextEx has buffered but not yet
+// returned. p.mu must be held.
+func (p *Pcap) discardBuffered() {
+	if f := p.filterStat(p.bufGen); f != nil {
+		f.Discarded += uint64(p.max - p.used)
+	}
+	p.used = p.max
+}
@@ -0,0 +1,131 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+)
+
+// FlowKey identifies a conversation by protocol, addresses and ports. The
+// two endpoints are stored in a canonical order, so both directions of a
+// conversation have the same key. IPv4 addresses use the IPv4-in-IPv6 form.
+type FlowKey struct {
+	Proto uint8
+	AddrA [16]byte
+	AddrB [16]byte
+	PortA uint16
+	PortB uint16
+}
+
+// FlowKeyOf extracts the flow key of pkt without decoding it. It returns
+// false for packets that are not IPv4 or IPv6.
+func FlowKeyOf(pkt *Packet) (key FlowKey, ok bool) {
+	etherType, nh, ok := linkPayload(pkt)
+	if !ok {
+		return
+	}
+	var l4 []byte
+	switch etherType {
+	case TYPE_IP:
+		if len(nh) < 20 || nh[0]>>4 != 4 {
+			return key, false
+		}
+		key.Proto = nh[9]
+		copy(key.AddrA[:], net.IP(nh[12:16]).To16())
+		copy(key.AddrB[:], net.IP(nh[16:20]).To16())
+		ihl := int(nh[0]&0x0F) * 4
+		// Only the first fragment carries the ports.
+		if binary.BigEndian.Uint16(nh[6:8])&0x1FFF == 0 && ihl >= 20 && ihl <= len(nh) {
+			l4 = nh[ihl:]
+		}
+	case TYPE_IP6:
+		if len(nh) < 40 {
+			return key, false
+		}
+		key.Proto = nh[6]
+		copy(key.AddrA[:], nh[8:24])
+		copy(key.AddrB[:], nh[24:40])
+		l4 = nh[40:]
+	default:
+		return key, false
+	}
+	if (key.Proto == IP_TCP || key.Proto == IP_UDP) && len(l4) >= 4 {
+		key.PortA = binary.BigEndian.Uint16(l4[0:2])
+		key.PortB = binary.BigEndian.Uint16(l4[2:4])
+	}
+	key.canonical()
+	return key, true
+}
+
+func (k *FlowKey) canonical() {
+	for i := range k.AddrA {
+		if k.AddrA[i] != k.AddrB[i] {
+			if k.AddrA[i] > k.AddrB[i] {
+				k.swap()
+			}
+			return
+		}
+	}
+	if k.PortA > k.PortB {
+		k.swap()
+	}
+}
+
+func (k *FlowKey) swap() {
+	k.AddrA, k.AddrB = k.AddrB, k.AddrA
+	k.PortA, k.PortB = k.PortB, k.PortA
+}
+
+// Hash returns a 64-bit FNV-1a hash of the key mixed with salt.
+func (k FlowKey) Hash(salt uint64) uint64 {
+	var buf [8 + 1 + 32 + 4]byte
+	binary.BigEndian.PutUint64(buf[0:], salt)
+	buf[8] = k.Proto
+	copy(buf[9:], k.AddrA[:])
+	copy(buf[25:], k.AddrB[:])
+	binary.BigEndian.PutUint16(buf[41:], k.PortA)
+	binary.BigEndian.PutUint16(buf[43:], k.PortB)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+func (k FlowKey) String() string {
+	return fmt.Sprintf("%d %s:%d-%s:%d", k.Proto,
+		net.IP(k.AddrA[:]), k.PortA, net.IP(k.AddrB[:]), k.PortB)
+}
+
+// linkPayload strips the link-layer header of pkt and returns the EtherType
+// of the network-layer data. LinkType 0 is treated as Ethernet, like Decode.
+func linkPayload(pkt *Packet) (etherType int, payload []byte, ok bool) {
+	data := pkt.Data
+	switch pkt.LinkType {
+	case LINKTYPE_RAW:
+		if len(data) == 0 {
+			return 0, nil, false
+		}
+		switch data[0] >> 4 {
+		case 4:
+			return TYPE_IP, data, true
+		case 6:
+			return TYPE_IP6, data, true
+		}
+		return 0, nil, false
+	case LINKTYPE_LINUX_SLL:
+		if len(data) < 16 {
+			return 0, nil, false
+		}
+		return int(binary.BigEndian.Uint16(data[14:16])), data[16:], true
+	}
+	if len(data) < 14 {
+		return 0, nil, false
+	}
+	etherType = int(binary.BigEndian.Uint16(data[12:14]))
+	off := 14
+	for (etherType == 0x8100 || etherType == 0x88A8) && len(data) >= off+4 {
+		etherType = int(binary.BigEndian.Uint16(data[off+2 : off+4]))
+		off += 4
+	}
+	return etherType, data[off:], true
+}
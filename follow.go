@@ -0,0 +1,114 @@
+package pcap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// errFileRotated is returned by a follower when the file it reads starts
+// over, so the Reader reads a new file header.
+var errFileRotated = errors.New("pcap: followed file rotated")
+
+// NewFollowReader opens the pcap file at path for reading while another
+// process is still writing it, like tail -f. At the end of the file, or
+// in a partly written record, the Reader waits for more data instead of
+// ending, checking every poll (250ms if zero), and resumes at the record
+// boundary. When path is replaced by a new file, or the file shrinks
+// below the read position, the Reader starts over with the new file
+// header; an unfinished record left behind is reported as skipped.
+//
+// Reading ends, and the file is closed, once ctx is done; Err then
+// returns an error wrapping ctx.Err(). NewFollowReader itself blocks
+// until the file header has been written.
+func NewFollowReader(ctx context.Context, path string, poll time.Duration) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if poll <= 0 {
+		poll = 250 * time.Millisecond
+	}
+	r, err := NewReader(&follower{ctx: ctx, path: path, file: f, poll: poll})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// follower reads a growing file, blocking at its end.
+type follower struct {
+	ctx  context.Context
+	path string
+	file *os.File
+	pos  int64
+	poll time.Duration
+}
+
+func (f *follower) Read(p []byte) (int, error) {
+	for {
+		if err := f.ctx.Err(); err != nil {
+			if f.file != nil {
+				f.file.Close()
+				f.file = nil
+			}
+			return 0, err
+		}
+		n, err := f.file.Read(p)
+		f.pos += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if rotated, err := f.rotated(); err != nil || rotated {
+			if err == nil {
+				err = errFileRotated
+			}
+			return 0, err
+		}
+		t := time.NewTimer(f.poll)
+		select {
+		case <-f.ctx.Done():
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// rotated checks, at the end of the file, whether the file was truncated
+// or path now names another file, and if so switches to its start.
+func (f *follower) rotated() (bool, error) {
+	cur, err := f.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if cur.Size() < f.pos {
+		if _, err = f.file.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		f.pos = 0
+		return true, nil
+	}
+	if cur.Size() > f.pos {
+		// Written since the last read, drain it first.
+		return false, nil
+	}
+	fi, err := os.Stat(f.path)
+	if err != nil || os.SameFile(cur, fi) {
+		// Missing while the writer rotates, or unchanged.
+		return false, nil
+	}
+	nf, err := os.Open(f.path)
+	if err != nil {
+		return false, nil
+	}
+	f.file.Close()
+	f.file = nf
+	f.pos = 0
+	return true, nil
+}
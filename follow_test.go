@@ -0,0 +1,93 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFollowReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grow.pcap")
+	start := time.Unix(1500000000, 0)
+	record := func(port uint16) []byte {
+		var buf bytes.Buffer
+		w, _ := NewWriter(&buf, testHeader())
+		w.Write(udpPacket(start.Add(time.Duration(port)*time.Second), 1, 2, port, 53, nil))
+		return buf.Bytes()[24:]
+	}
+	var hdr bytes.Buffer
+	NewWriter(&hdr, testHeader())
+	appendFile := func(b []byte) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(b)
+		f.Close()
+	}
+	appendFile(append(hdr.Bytes(), record(0)...))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := NewFollowReader(ctx, path, 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var skips []Skip
+	r.OnSkip = func(s Skip) { skips = append(skips, s) }
+	port := func() int {
+		pkt := r.Next()
+		if pkt == nil {
+			return -1
+		}
+		key, _ := FlowKeyOf(pkt)
+		return int(key.PortA)
+	}
+	if p := port(); p != 0 {
+		t.Fatalf("first packet from port %d", p)
+	}
+
+	// A record written in two parts.
+	rec := record(1)
+	appendFile(rec[:20])
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		appendFile(rec[20:])
+	}()
+	if p := port(); p != 1 {
+		t.Fatalf("partly written packet from port %d", p)
+	}
+
+	// Truncated and rewritten.
+	os.WriteFile(path, append(hdr.Bytes(), record(2)...)[:50], 0644)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		appendFile(append(hdr.Bytes(), record(2)...)[50:])
+	}()
+	if p := port(); p != 2 {
+		t.Fatalf("packet after truncation from port %d", p)
+	}
+
+	// Rotated, leaving a partial record behind.
+	appendFile(record(3)[:30])
+	os.Rename(path, path+".1")
+	appendFile(append(hdr.Bytes(), record(4)...))
+	if p := port(); p != 4 {
+		t.Fatalf("packet after rotation from port %d", p)
+	}
+	if len(skips) != 1 || skips[0].Bytes != 30 {
+		t.Fatalf("skips %+v", skips)
+	}
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+	}()
+	if p := port(); p != -1 || !errors.Is(r.Err(), context.Canceled) {
+		t.Fatalf("after cancel: port %d, %v", p, r.Err())
+	}
+}
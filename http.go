@@ -0,0 +1,195 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// CaptureHandler is an http.Handler that captures on an interface and
+// streams the packets to the client as a pcap file, or a pcapng file with
+// format=pcapng. The body is sent with chunked transfer encoding and
+// flushed after every packet, so it can be piped into a live viewer:
+//
+//	curl 'host:port/capture?if=eth0&filter=port+53' | wireshark -k -i -
+//
+// The GET parameters are if (the interface), filter (a BPF expression),
+// snaplen, duration (like "30s", or seconds), count (packets) and format.
+// The capture ends when a limit is reached or the client disconnects. A
+// capture that fails after the response has started reports the error in
+// the X-Capture-Error trailer.
+type CaptureHandler struct {
+	// Interfaces lists the interfaces clients may capture on. Requests for
+	// other interfaces are refused.
+	Interfaces []string
+
+	MaxSnapLen  int32         // largest and default snaplen, 65535 if zero
+	MaxDuration time.Duration // longest and default capture, one minute if zero
+	MaxBytes    uint64        // stop after this much packet data, unlimited if zero
+	MaxCaptures int32         // concurrent captures, unlimited if zero
+
+	// Open opens the handle to capture on. It defaults to OpenLive with a
+	// 100ms read timeout; it may also return a RemoteClient, for example.
+	Open func(device string, snaplen int32) (Handle, error)
+
+	active int32
+}
+
+// captureRequest is a validated capture request.
+type captureRequest struct {
+	device  string
+	filter  string
+	snaplen int32
+	limits  Limits
+	pcapng  bool
+}
+
+func (h *CaptureHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, status, err := h.parse(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if n := atomic.AddInt32(&h.active, 1); h.MaxCaptures > 0 && n > h.MaxCaptures {
+		atomic.AddInt32(&h.active, -1)
+		http.Error(w, "too many captures", http.StatusServiceUnavailable)
+		return
+	}
+	defer atomic.AddInt32(&h.active, -1)
+
+	open := h.Open
+	if open == nil {
+		open = func(device string, snaplen int32) (Handle, error) {
+			return OpenLive(device, snaplen, false, 100)
+		}
+	}
+	p, err := open(req.device, req.snaplen)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer p.Close()
+	if req.filter != "" {
+		if err := p.SetFilter(req.filter); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	linkType := packetLinkType(p)
+	var out interface{ Write(*Packet) error }
+	if req.pcapng {
+		w.Header().Set("Content-Type", "application/x-pcapng")
+		out, err = NewNgWriter(w, NgSection{UserAppl: "pcap"}, []NgInterface{
+			{LinkType: linkType, SnapLen: uint32(req.snaplen), Name: req.device, Filter: req.filter},
+		})
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		out, err = NewWriter(w, &FileHeader{
+			MagicNumber:  TCPDUMP_MAGIC,
+			VersionMajor: 2,
+			VersionMinor: 4,
+			SnapLen:      uint32(req.snaplen),
+			LinkType:     uint32(linkType),
+		})
+	}
+	if err != nil {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	// The request context is done when the client disconnects.
+	sum, err := Capture(r.Context(), p, req.limits, func(pkt *Packet) error {
+		if err := out.Write(pkt); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && sum.Reason != StopContext {
+		w.Header().Set(http.TrailerPrefix+"X-Capture-Error", err.Error())
+	}
+}
+
+// parse validates the parameters of r against the limits of h. It returns
+// the HTTP status to reply with on error.
+func (h *CaptureHandler) parse(r *http.Request) (*captureRequest, int, error) {
+	q := r.URL.Query()
+	req := &captureRequest{
+		device:  q.Get("if"),
+		filter:  q.Get("filter"),
+		snaplen: h.MaxSnapLen,
+		limits:  Limits{Duration: h.MaxDuration, Bytes: h.MaxBytes},
+	}
+	if req.snaplen <= 0 {
+		req.snaplen = 65535
+	}
+	if req.limits.Duration <= 0 {
+		req.limits.Duration = time.Minute
+	}
+	if req.device == "" {
+		return nil, http.StatusBadRequest, errors.New("pcap: missing interface")
+	}
+	allowed := false
+	for _, name := range h.Interfaces {
+		if name == req.device {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, http.StatusForbidden, fmt.Errorf("pcap: interface %q not allowed", req.device)
+	}
+	if s := q.Get("snaplen"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || n <= 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("pcap: bad snaplen %q", s)
+		}
+		if int32(n) < req.snaplen {
+			req.snaplen = int32(n)
+		}
+	}
+	if s := q.Get("duration"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			secs, serr := strconv.ParseUint(s, 10, 32)
+			if serr != nil {
+				return nil, http.StatusBadRequest, fmt.Errorf("pcap: bad duration %q", s)
+			}
+			d = time.Duration(secs) * time.Second
+		}
+		if d <= 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("pcap: bad duration %q", s)
+		}
+		if d < req.limits.Duration {
+			req.limits.Duration = d
+		}
+	}
+	if s := q.Get("count"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || n == 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("pcap: bad count %q", s)
+		}
+		req.limits.Packets = n
+	}
+	switch format := q.Get("format"); format {
+	case "", "pcap":
+	case "pcapng":
+		req.pcapng = true
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("pcap: unknown format %q", format)
+	}
+	return req, 0, nil
+}
@@ -0,0 +1,131 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCaptureHandlerRequests(t *testing.T) {
+	h := &CaptureHandler{Interfaces: []string{"lo"}}
+	for _, tc := range []struct {
+		method, query string
+		status        int
+	}{
+		{"POST", "if=lo", http.StatusMethodNotAllowed},
+		{"GET", "", http.StatusBadRequest},
+		{"GET", "if=eth0", http.StatusForbidden},
+		{"GET", "if=lo&snaplen=-1", http.StatusBadRequest},
+		{"GET", "if=lo&duration=soon", http.StatusBadRequest},
+		{"GET", "if=lo&count=0", http.StatusBadRequest},
+		{"GET", "if=lo&format=erf", http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, "/capture?"+tc.query, nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s %s: status %d, want %d", tc.method, tc.query, rec.Code, tc.status)
+		}
+	}
+
+	h.MaxSnapLen, h.MaxDuration = 1000, 10*time.Second
+	req, _, err := h.parse(httptest.NewRequest("GET", "/capture?if=lo&snaplen=5000&duration=3&count=7", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.snaplen != 1000 || req.limits.Duration != 3*time.Second || req.limits.Packets != 7 {
+		t.Fatalf("got %+v", req)
+	}
+}
+
+func TestCaptureHandlerOpen(t *testing.T) {
+	var fh *fakeHandle
+	h := &CaptureHandler{Interfaces: []string{"lo"}, Open: func(device string, snaplen int32) (Handle, error) {
+		fh = &fakeHandle{closed: make(chan struct{})}
+		for i := 0; i < 3; i++ {
+			fh.pkts = append(fh.pkts, &Packet{Time: time.Unix(1500000000, 0), Len: 4, Caplen: 4, Data: []byte{0x45, 0, 0, byte(i)}})
+		}
+		return fh, nil
+	}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/capture?if=lo&count=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r, err := NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header.LinkType != LINKTYPE_RAW {
+		t.Errorf("link type %d", r.Header.LinkType)
+	}
+	n := 0
+	for pkt := r.Next(); pkt != nil; pkt = r.Next() {
+		n++
+	}
+	if r.Err() != nil || n != 3 || resp.Trailer.Get("X-Capture-Error") != "" {
+		t.Fatalf("read %d packets err:%v trailer:%q", n, r.Err(), resp.Trailer.Get("X-Capture-Error"))
+	}
+	select {
+	case <-fh.closed:
+	default:
+		t.Error("handle not closed")
+	}
+
+	h.Open = func(device string, snaplen int32) (Handle, error) {
+		return failHandle{&fakeHandle{closed: make(chan struct{})}}, nil
+	}
+	resp, err = http.Get(srv.URL + "/capture?if=lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if e := resp.Trailer.Get("X-Capture-Error"); e != "read failed" {
+		t.Fatalf("got trailer %q", e)
+	}
+}
+
+// failHandle fails the first read.
+type failHandle struct{ *fakeHandle }
+
+func (failHandle) NextEx(pkt *Packet) (*Packet, int32) { return pkt, -1 }
+func (failHandle) Geterror() error                     { return errors.New("read failed") }
+
+func TestPcapCaptureHandler(t *testing.T) {
+	srv := httptest.NewServer(&CaptureHandler{Interfaces: []string{"lo"}})
+	defer srv.Close()
+
+	port, numPkts := 54323, 5
+	go udpSvr(port, numPkts, t)
+	go udpClient(port, numPkts, 1*time.Second, t)
+
+	resp, err := http.Get(fmt.Sprintf("%s/capture?if=lo&filter=udp+dst+port+%d&count=%d&duration=10s", srv.URL, port, numPkts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %s", resp.Status)
+	}
+	r, err := NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for pkt := r.Next(); pkt != nil; pkt = r.Next() {
+		n++
+	}
+	if r.Err() != nil || n != numPkts {
+		t.Fatalf("read %d of %d packets err:%v", n, numPkts, r.Err())
+	}
+	if e := resp.Trailer.Get("X-Capture-Error"); e != "" {
+		t.Fatalf("capture failed: %s", e)
+	}
+}
@@ -0,0 +1,236 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// fileHeaderSize is the size of the classic pcap file header; the first
+// record starts right after it.
+const fileHeaderSize = 24
+
+// indexMagic starts an index sidecar file.
+const indexMagic = "PCAPIDX1"
+
+// IndexEntry locates a record of a pcap file.
+type IndexEntry struct {
+	Packet uint64 // record number, the first record is 0
+	Offset int64  // file offset of the record header
+	Time   time.Time
+}
+
+// Index holds the offsets of every Every-th record of a classic pcap file,
+// so a Reader can seek without scanning the file from its start.
+type Index struct {
+	Every   int
+	Packets uint64    // records in the file
+	Size    int64     // bytes indexed, the file size when the index was built
+	First   time.Time // timestamp of the first record
+	Last    time.Time // timestamp of the last record
+	Entries []IndexEntry
+}
+
+// BuildIndex reads a whole pcap file from r and indexes every every-th
+// record. It fails on the first record a strict Reader rejects, so a
+// successful build also validates the file.
+func BuildIndex(r io.Reader, every int) (*Index, error) {
+	if every <= 0 {
+		return nil, fmt.Errorf("pcap: bad index interval %d", every)
+	}
+	pr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	ix := &Index{Every: every}
+	pkt := new(Packet)
+	for {
+		offset := pr.offset
+		if _, err = pr.readPacket(pkt, nil, true); err != nil {
+			break
+		}
+		if ix.Packets%uint64(every) == 0 {
+			ix.Entries = append(ix.Entries, IndexEntry{ix.Packets, offset, pkt.Time})
+		}
+		if ix.Packets == 0 {
+			ix.First = pkt.Time
+		}
+		ix.Last = pkt.Time
+		ix.Packets++
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	ix.Size = pr.offset
+	return ix, nil
+}
+
+// IndexPath returns the path of the index sidecar file for a pcap file.
+func IndexPath(path string) string {
+	return path + ".idx"
+}
+
+// Save writes the index to path, usually IndexPath of the pcap file.
+func (ix *Index) Save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = ix.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// LoadIndex reads an index written by Save. Compare Size with the pcap
+// file's size to tell whether the index is still current.
+func LoadIndex(path string) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadIndex(f)
+}
+
+// WriteTo writes the index in its sidecar format.
+func (ix *Index) WriteTo(w io.Writer) (int64, error) {
+	b := make([]byte, 0, 48+24*len(ix.Entries))
+	b = append(b, indexMagic...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(ix.Every))
+	b = binary.LittleEndian.AppendUint64(b, ix.Packets)
+	b = binary.LittleEndian.AppendUint64(b, uint64(ix.Size))
+	b = binary.LittleEndian.AppendUint64(b, uint64(ix.First.UnixNano()))
+	b = binary.LittleEndian.AppendUint64(b, uint64(ix.Last.UnixNano()))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(ix.Entries)))
+	for _, e := range ix.Entries {
+		b = binary.LittleEndian.AppendUint64(b, e.Packet)
+		b = binary.LittleEndian.AppendUint64(b, uint64(e.Offset))
+		b = binary.LittleEndian.AppendUint64(b, uint64(e.Time.UnixNano()))
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ReadIndex reads an index in its sidecar format.
+func ReadIndex(r io.Reader) (*Index, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, 48)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, fmt.Errorf("pcap: index header: %w", err)
+	}
+	if string(head[:8]) != indexMagic {
+		return nil, errors.New("pcap: not an index file")
+	}
+	le := binary.LittleEndian
+	ix := &Index{
+		Every:   int(le.Uint32(head[8:12])),
+		Packets: le.Uint64(head[12:20]),
+		Size:    int64(le.Uint64(head[20:28])),
+		First:   time.Unix(0, int64(le.Uint64(head[28:36]))),
+		Last:    time.Unix(0, int64(le.Uint64(head[36:44]))),
+	}
+	n := le.Uint32(head[44:48])
+	if uint64(n) > ix.Packets {
+		return nil, fmt.Errorf("pcap: index has %d entries for %d packets", n, ix.Packets)
+	}
+	// n comes from the file: entries are appended as they are read, so a
+	// bogus count fails without a large allocation.
+	size := n
+	if size > 4096 {
+		size = 4096
+	}
+	ix.Entries = make([]IndexEntry, 0, size)
+	e := make([]byte, 24)
+	for i := uint32(0); i < n; i++ {
+		if _, err := io.ReadFull(br, e); err != nil {
+			return nil, fmt.Errorf("pcap: index entry %d: %w", i, err)
+		}
+		ix.Entries = append(ix.Entries, IndexEntry{
+			Packet: le.Uint64(e[0:8]),
+			Offset: int64(le.Uint64(e[8:16])),
+			Time:   time.Unix(0, int64(le.Uint64(e[16:24]))),
+		})
+	}
+	return ix, nil
+}
+
+// SeekPacket positions the Reader so that the next packet read is record
+// n, counting from 0. The underlying io.Reader must be an io.Seeker. It
+// starts from the closest Index entry at or before n and skips the
+// remaining records.
+func (r *Reader) SeekPacket(n uint64) error {
+	e := IndexEntry{Offset: fileHeaderSize}
+	if ix := r.Index; ix != nil {
+		i := sort.Search(len(ix.Entries), func(i int) bool { return ix.Entries[i].Packet > n })
+		if i > 0 {
+			e = ix.Entries[i-1]
+		}
+	}
+	if err := r.seek(e.Offset, e.Packet); err != nil {
+		return err
+	}
+	pkt := new(Packet)
+	for r.count < n {
+		if _, err := r.readPacket(pkt, nil, true); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("pcap: packet %d beyond end of file with %d packets", n, r.count)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// SeekTime positions the Reader at the first record at or after t, or at
+// the end of the file if there is none. It starts from the last Index
+// entry before t, which assumes timestamps that do not go backwards by
+// more than the index interval.
+func (r *Reader) SeekTime(t time.Time) error {
+	e := IndexEntry{Offset: fileHeaderSize}
+	if ix := r.Index; ix != nil {
+		i := sort.Search(len(ix.Entries), func(i int) bool { return !ix.Entries[i].Time.Before(t) })
+		if i > 0 {
+			e = ix.Entries[i-1]
+		}
+	}
+	if err := r.seek(e.Offset, e.Packet); err != nil {
+		return err
+	}
+	pkt := new(Packet)
+	for {
+		offset, count := r.offset, r.count
+		if _, err := r.readPacket(pkt, nil, true); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !pkt.Time.Before(t) {
+			return r.seek(offset, count)
+		}
+	}
+}
+
+// seek moves to a record boundary at offset, which is record number count.
+func (r *Reader) seek(offset int64, count uint64) error {
+	s, ok := r.src.(io.Seeker)
+	if !ok {
+		return errors.New("pcap: reader is not seekable")
+	}
+	if _, err := s.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.buf.Reset(r.src)
+	r.offset = offset
+	r.count = count
+	r.lastSec = 0
+	r.err = nil
+	return nil
+}
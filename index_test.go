@@ -0,0 +1,84 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndexSeek(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, testHeader())
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < 1000; i++ {
+		w.Write(udpPacket(start.Add(time.Duration(i)*time.Millisecond), 1, 2, uint16(i), 53, make([]byte, i%50)))
+	}
+	data := buf.Bytes()
+
+	ix, err := BuildIndex(bytes.NewReader(data), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix.Packets != 1000 || len(ix.Entries) != 10 || ix.Size != int64(len(data)) ||
+		!ix.First.Equal(start) || !ix.Last.Equal(start.Add(999*time.Millisecond)) {
+		t.Fatalf("index %+v", ix)
+	}
+	path := IndexPath(filepath.Join(t.TempDir(), "test.pcap"))
+	if err := ix.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if ix, err = LoadIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(ix.Entries) != 10 || ix.Entries[5].Packet != 500 || !ix.Entries[5].Time.Equal(start.Add(500*time.Millisecond)) {
+		t.Fatalf("loaded index %+v", ix)
+	}
+
+	port := func(r *Reader) int {
+		pkt := r.Next()
+		if pkt == nil {
+			return -1
+		}
+		key, _ := FlowKeyOf(pkt)
+		return int(key.PortA)
+	}
+	for _, index := range []*Index{nil, ix} {
+		r, _ := NewReader(bytes.NewReader(data))
+		r.Index = index
+		if err := r.SeekPacket(537); err != nil || port(r) != 537 || port(r) != 538 {
+			t.Fatalf("SeekPacket(537): %v", err)
+		}
+		if err := r.SeekPacket(0); err != nil || port(r) != 0 {
+			t.Fatalf("SeekPacket(0): %v", err)
+		}
+		if err := r.SeekTime(start.Add(742500 * time.Microsecond)); err != nil || port(r) != 743 {
+			t.Fatalf("SeekTime: %v", err)
+		}
+		if err := r.SeekTime(start.Add(time.Hour)); err != nil || port(r) != -1 || r.Err() != nil {
+			t.Fatalf("SeekTime past end: %v", err)
+		}
+		if err := r.SeekPacket(1001); err == nil {
+			t.Fatal("SeekPacket past end succeeded")
+		}
+	}
+
+	r, _ := NewReader(bytes.NewBuffer(data))
+	if err := r.SeekPacket(1); err == nil {
+		t.Fatal("seeking a non-seekable reader succeeded")
+	}
+	if _, err := BuildIndex(bytes.NewReader(data[:len(data)-5]), 100); err == nil {
+		t.Fatal("BuildIndex accepted a truncated file")
+	}
+
+	// A huge entry count fails at the end of the data.
+	var ib bytes.Buffer
+	ix.WriteTo(&ib)
+	bogus := ib.Bytes()[:48]
+	binary.LittleEndian.PutUint64(bogus[12:20], 1<<40)
+	binary.LittleEndian.PutUint32(bogus[44:48], 0xffffffff)
+	if _, err := ReadIndex(bytes.NewReader(bogus)); err == nil {
+		t.Fatal("ReadIndex accepted a truncated index")
+	}
+}
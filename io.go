@@ -1,7 +1,10 @@
 package pcap
 
 import (
+	"bufio"
+	"compress/gzip"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -23,35 +26,175 @@ type FileHeader struct {
 	LinkType uint32
 }
 
+// TimePrecision is the resolution of the timestamps in a pcap file.
+type TimePrecision int
+
+const (
+	PrecisionHeader TimePrecision = iota // as given by FileHeader.MagicNumber
+	PrecisionMicro                       // TCPDUMP_MAGIC, microseconds
+	PrecisionNano                        // NSEC_TCPDUMP_MAGIC, nanoseconds
+)
+
+// Precision returns the timestamp precision implied by the magic number.
+func (h *FileHeader) Precision() TimePrecision {
+	if nsecMagic(h.MagicNumber) {
+		return PrecisionNano
+	}
+	return PrecisionMicro
+}
+
+// knownMagic reports whether magic is a pcap magic number Reader accepts.
+// NAVTEL_TCPDUMP_MAGIC files use the standard record layout with
+// nanosecond timestamps.
+func knownMagic(magic uint32) bool {
+	switch magic {
+	case TCPDUMP_MAGIC, NSEC_TCPDUMP_MAGIC, KUZNETZOV_TCPDUMP_MAGIC, NAVTEL_TCPDUMP_MAGIC:
+		return true
+	}
+	return false
+}
+
+// unsupportedMagic reports whether magic names a pcap variant with a
+// record layout Reader does not know. FMESQUITA_TCPDUMP_MAGIC files have
+// extra record fields that were never documented.
+func unsupportedMagic(magic uint32) bool {
+	return magic == FMESQUITA_TCPDUMP_MAGIC
+}
+
+func nsecMagic(magic uint32) bool {
+	return magic == NSEC_TCPDUMP_MAGIC || magic == NAVTEL_TCPDUMP_MAGIC
+}
+
+// ReadError reports a problem at an offset of a pcap file. Err is
+// io.ErrUnexpectedEOF for a truncated file.
+type ReadError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("pcap: offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *ReadError) Unwrap() error { return e.Err }
+
+// MAXIMUM_SNAPLEN is the largest snaplen libpcap accepts, used as the
+// record size limit for files whose header has no usable SnapLen.
+const MAXIMUM_SNAPLEN = 262144
+
+// Skip describes a region of a capture file that a lenient Reader could not
+// parse and skipped.
+type Skip struct {
+	Offset int64 // file offset of the first skipped byte
+	Bytes  int64
+	Reason string
+}
+
 // Reader parses pcap files.
 type Reader struct {
-	flip         bool
-	buf          io.Reader
-	err          error
-	fourBytes    []byte
-	twoBytes     []byte
-	sixteenBytes []byte
-	Header       FileHeader
+	flip      bool
+	nsec      bool
+	buf       *bufio.Reader
+	err       error
+	offset    int64
+	fourBytes []byte
+	twoBytes  []byte
+	recHdr    []byte
+	recLen    int // record header size, 16 or 24 for KUZNETZOV_TCPDUMP_MAGIC
+	Header    FileHeader
+
+	// MaxRecordSize is the largest captured length accepted for a record.
+	// Zero means Header.SnapLen, or MAXIMUM_SNAPLEN if SnapLen is zero or
+	// larger than that.
+	MaxRecordSize uint32
+
+	// Lenient makes the Reader skip implausible records instead of failing:
+	// oversized records, a captured length above the original length, bad
+	// sub-second fields and timestamps that move by more than MaxTimeJump
+	// from the previous record. It resynchronises on the next plausible
+	// record header, and treats a truncated final record as end of file.
+	Lenient     bool
+	MaxTimeJump time.Duration // defaults to one year
+
+	// OnSkip, if set, is called for every region a lenient Reader skips.
+	OnSkip func(Skip)
+
+	// ZeroCopy makes ReadPacketInto return data that points into the
+	// Reader's internal buffer, valid until the next call. Its buf argument
+	// is then ignored. Next and ReadPacket always return their own copy.
+	ZeroCopy bool
+	scratch  []byte // records larger than the read buffer in ZeroCopy mode
+
+	// Index, if set, lets SeekPacket and SeekTime start near their target
+	// instead of at the first record.
+	Index *Index
+
+	src          io.Reader
+	count        uint64 // records read, the number of the next record
+	lastSec      int64
+	skipped      int
+	skippedBytes int64
 }
 
-// NewReader reads pcap data from an io.Reader.
+// NewReader reads pcap data from an io.Reader. Gzip-compressed data is
+// detected by its magic bytes and decompressed transparently.
 func NewReader(reader io.Reader) (*Reader, error) {
+	buf := bufio.NewReaderSize(reader, 1<<16)
+	gz, err := gunzip(buf)
+	if err != nil {
+		return nil, err
+	}
+	if gz != nil {
+		reader = gz
+		buf = bufio.NewReaderSize(gz, 1<<16)
+	}
 	r := &Reader{
-		buf:          reader,
-		fourBytes:    make([]byte, 4),
-		twoBytes:     make([]byte, 2),
-		sixteenBytes: make([]byte, 16),
+		src:       reader,
+		buf:       buf,
+		fourBytes: make([]byte, 4),
+		twoBytes:  make([]byte, 2),
+		recHdr:    make([]byte, 24),
 	}
-	switch magic := r.readUint32(); magic {
-	case 0xa1b2c3d4:
+	if err := r.readHeader(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// restart reads the file header of a followed file that starts over.
+func (r *Reader) restart() error {
+	r.err = nil
+	r.offset = 0
+	r.count = 0
+	r.lastSec = 0
+	return r.readHeader()
+}
+
+func (r *Reader) readHeader() error {
+	magic := r.readUint32()
+	if r.err != nil {
+		return r.headerError()
+	}
+	switch {
+	case knownMagic(magic):
 		r.flip = false
-	case 0xd4c3b2a1:
+	case knownMagic(swap32(magic)):
 		r.flip = true
+		magic = swap32(magic)
+	case unsupportedMagic(magic) || unsupportedMagic(swap32(magic)):
+		r.err = fmt.Errorf("pcap: unsupported format: magic number %0x", magic)
+		return r.err
 	default:
-		return nil, fmt.Errorf("pcap: bad magic number: %0x", magic)
+		r.err = fmt.Errorf("pcap: bad magic number: %0x", magic)
+		return r.err
+	}
+	r.nsec = nsecMagic(magic)
+	r.recLen = 16
+	if magic == KUZNETZOV_TCPDUMP_MAGIC {
+		r.recLen = 24
 	}
 	r.Header = FileHeader{
-		MagicNumber:  0xa1b2c3d4,
+		MagicNumber:  magic,
 		VersionMajor: r.readUint16(),
 		VersionMinor: r.readUint16(),
 		TimeZone:     r.readInt32(),
@@ -59,47 +202,309 @@ func NewReader(reader io.Reader) (*Reader, error) {
 		SnapLen:      r.readUint32(),
 		LinkType:     r.readUint32(),
 	}
-	return r, nil
+	if r.err != nil {
+		return r.headerError()
+	}
+	return nil
+}
+
+func (r *Reader) headerError() error {
+	if r.err == io.EOF {
+		r.err = io.ErrUnexpectedEOF
+	}
+	r.err = &ReadError{r.offset, fmt.Errorf("file header: %w", r.err)}
+	return r.err
+}
+
+// BigEndian reports whether the file is big-endian.
+func (r *Reader) BigEndian() bool {
+	return r.flip
 }
 
 // Next returns the next packet or nil if no more packets can be read.
+// Err tells whether the stream ended cleanly.
 func (r *Reader) Next() *Packet {
-	d := r.sixteenBytes
-	r.err = r.read(d)
-	if r.err != nil {
+	pkt, _ := r.ReadPacket()
+	return pkt
+}
+
+// Err returns the error that made Next return nil, or nil at a clean end
+// of file.
+func (r *Reader) Err() error {
+	if r.err == io.EOF {
 		return nil
 	}
+	return r.err
+}
+
+// ReadPacket returns the next packet. At a clean end of file the error is
+// io.EOF; a truncated record gives a *ReadError wrapping
+// io.ErrUnexpectedEOF, and an implausible record a *ReadError describing
+// it. Every packet carries the file's LinkType.
+func (r *Reader) ReadPacket() (*Packet, error) {
+	return r.readPacket(new(Packet), nil, false)
+}
+
+// ReadPacketInto is like ReadPacket but reuses pkt, as Pcap.NextEx reuses
+// its pktin argument, and reads the data into buf if it is large enough.
+// A nil pkt is allocated. Decoded headers of pkt are discarded.
+func (r *Reader) ReadPacketInto(pkt *Packet, buf []byte) (*Packet, error) {
+	if pkt == nil {
+		pkt = new(Packet)
+	} else {
+		*pkt = Packet{data: pkt.data, iphdr: pkt.iphdr, ip6hdr: pkt.ip6hdr, tcphdr: pkt.tcphdr}
+	}
+	return r.readPacket(pkt, buf, r.ZeroCopy)
+}
+
+func (r *Reader) readPacket(pkt *Packet, buf []byte, zeroCopy bool) (*Packet, error) {
+	for {
+		p, err := r.readRecord(pkt, buf, zeroCopy)
+		if err != errFileRotated {
+			return p, err
+		}
+		// A followed file was replaced or truncated, read the new header.
+		if r.err = r.restart(); r.err != nil {
+			return nil, r.err
+		}
+	}
+}
+
+func (r *Reader) readRecord(pkt *Packet, buf []byte, zeroCopy bool) (*Packet, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	d := r.recHdr[:r.recLen]
+	for {
+		start := r.offset
+		hdr, err := r.buf.Peek(r.recLen)
+		if err != nil {
+			r.err = r.stopped(start, err, len(hdr) > 0, "record header")
+			return nil, r.err
+		}
+		copy(d, hdr)
+		reason := r.check(d)
+		if reason == "" {
+			break
+		}
+		if !r.Lenient {
+			r.err = &ReadError{start, errors.New(reason)}
+			return nil, r.err
+		}
+		if r.err = r.resync(reason); r.err != nil {
+			return nil, r.err
+		}
+	}
+	start := r.offset
+	r.buf.Discard(r.recLen)
+	r.offset += int64(r.recLen)
 	timeSec := asUint32(d[0:4], r.flip)
-	timeUsec := asUint32(d[4:8], r.flip)
+	timeFrac := asUint32(d[4:8], r.flip)
 	capLen := asUint32(d[8:12], r.flip)
 	origLen := asUint32(d[12:16], r.flip)
 
-	data := make([]byte, capLen)
-	if r.err = r.read(data); r.err != nil {
-		return nil
+	var data []byte
+	switch {
+	case zeroCopy && int(capLen) <= r.buf.Size():
+		// The peeked bytes stay in place until the buffer is refilled.
+		if data, r.err = r.buf.Peek(int(capLen)); r.err != nil {
+			r.err = r.stopped(start, r.err, true, "record data")
+			return nil, r.err
+		}
+		r.buf.Discard(int(capLen))
+		r.offset += int64(capLen)
+	default:
+		if zeroCopy {
+			buf = r.scratch
+		}
+		if uint32(cap(buf)) >= capLen {
+			data = buf[:capLen]
+			r.err = r.read(data)
+		} else {
+			data, r.err = r.readGrowing(capLen)
+		}
+		if zeroCopy {
+			r.scratch = data
+		}
+		if r.err != nil {
+			r.err = r.stopped(start, r.err, true, "record data")
+			return nil, r.err
+		}
+	}
+	r.lastSec = int64(timeSec)
+	r.count++
+	timeNsec := int64(timeFrac)
+	if !r.nsec {
+		timeNsec *= 1000
 	}
-	return &Packet{
-		Time:   time.Unix(int64(timeSec), int64(timeUsec)),
-		Caplen: capLen,
-		Len:    origLen,
-		Data:   data,
+	pkt.Time = time.Unix(int64(timeSec), timeNsec)
+	pkt.Caplen = capLen
+	pkt.Len = origLen
+	pkt.Data = data
+	pkt.LinkType = int(r.Header.LinkType)
+	if r.recLen == 24 {
+		pkt.IfIndex = int32(asUint32(d[16:20], r.flip))
+		pkt.Protocol = asUint16(d[20:22], r.flip)
+		pkt.PktType = d[22]
 	}
+	return pkt, nil
 }
 
-func (r *Reader) read(data []byte) error {
-	var err error
-	n, err := r.buf.Read(data)
-	for err == nil && n != len(data) {
-		var chunk int
-		chunk, err = r.buf.Read(data[n:])
-		n += chunk
-	}
-	if len(data) == n {
+// Skipped returns the number of regions and bytes a lenient Reader skipped.
+func (r *Reader) Skipped() (regions int, bytes int64) {
+	return r.skipped, r.skippedBytes
+}
+
+// stopped returns the error for a read of the record at start that failed
+// with err, after part of the record was read if partial is set.
+func (r *Reader) stopped(start int64, err error, partial bool, what string) error {
+	switch {
+	case !partial && (err == io.EOF || err == errFileRotated):
+		return err
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return r.truncated(start, what)
+	case err == errFileRotated:
+		r.skip(start, r.offset-start+int64(r.buf.Buffered()), "unfinished "+what+" before rotation")
+		r.buf.Discard(r.buf.Buffered())
+		return err
+	}
+	return &ReadError{start, fmt.Errorf("%s: %w", what, err)}
+}
+
+// truncated returns the error for a record cut short at the end of the
+// file. A lenient Reader reports the partial record as skipped and ends
+// the stream cleanly.
+func (r *Reader) truncated(start int64, what string) error {
+	if r.Lenient {
+		r.skip(start, r.offset-start+int64(r.buf.Buffered()), "truncated "+what)
+		r.buf.Discard(r.buf.Buffered())
+		return io.EOF
+	}
+	return &ReadError{start, fmt.Errorf("%s: %w", what, io.ErrUnexpectedEOF)}
+}
+
+func (r *Reader) maxRecord() uint32 {
+	if r.MaxRecordSize > 0 {
+		return r.MaxRecordSize
+	}
+	return recordLimit(&r.Header)
+}
+
+// recordLimit returns the largest plausible record for a file with header h.
+func recordLimit(h *FileHeader) uint32 {
+	if h.SnapLen > 0 && h.SnapLen <= MAXIMUM_SNAPLEN {
+		return h.SnapLen
+	}
+	return MAXIMUM_SNAPLEN
+}
+
+// check returns why the record header d is implausible, or "" if it is
+// fine. Only the size limit applies to a strict Reader.
+func (r *Reader) check(d []byte) string {
+	capLen := asUint32(d[8:12], r.flip)
+	if max := r.maxRecord(); capLen > max {
+		return fmt.Sprintf("record length %d exceeds limit %d", capLen, max)
+	}
+	if !r.Lenient {
+		return ""
+	}
+	if origLen := asUint32(d[12:16], r.flip); capLen > origLen {
+		return fmt.Sprintf("captured length %d exceeds original length %d", capLen, origLen)
+	}
+	frac, limit := asUint32(d[4:8], r.flip), uint32(1000000)
+	if r.nsec {
+		limit = 1000000000
+	}
+	if frac >= limit {
+		return fmt.Sprintf("bad sub-second timestamp %d", frac)
+	}
+	if r.lastSec != 0 {
+		jump := r.MaxTimeJump
+		if jump <= 0 {
+			jump = 365 * 24 * time.Hour
+		}
+		delta := time.Duration(int64(asUint32(d[0:4], r.flip))-r.lastSec) * time.Second
+		if delta > jump || delta < -jump {
+			return fmt.Sprintf("timestamp moves by %s", delta)
+		}
+	}
+	return ""
+}
+
+// resync skips bytes until a plausible record header whose successor, if
+// it can be seen in the buffer, is plausible too.
+func (r *Reader) resync(reason string) error {
+	start := r.offset
+	d := make([]byte, r.recLen)
+	for {
+		r.buf.Discard(1)
+		r.offset++
+		hdr, err := r.buf.Peek(r.recLen)
+		if err != nil {
+			r.skip(start, r.offset-start+int64(len(hdr)), reason)
+			r.buf.Discard(len(hdr))
+			if err == errFileRotated {
+				return err
+			}
+			return io.EOF
+		}
+		copy(d, hdr)
+		if r.check(d) != "" {
+			continue
+		}
+		// Confirm with the following header. At the end of the file, or
+		// when the record does not fit the buffer, trust this one alone.
+		next := r.recLen + int(asUint32(d[8:12], r.flip))
+		if more, err := r.buf.Peek(next + r.recLen); err == nil && r.check(more[next:]) != "" {
+			continue
+		}
+		r.skip(start, r.offset-start, reason)
 		return nil
 	}
+}
+
+func (r *Reader) skip(offset, n int64, reason string) {
+	r.skipped++
+	r.skippedBytes += n
+	if r.OnSkip != nil {
+		r.OnSkip(Skip{Offset: offset, Bytes: n, Reason: reason})
+	}
+}
+
+// read fills data. It returns io.EOF if nothing could be read and
+// io.ErrUnexpectedEOF if data was only partly filled.
+func (r *Reader) read(data []byte) error {
+	n, err := io.ReadFull(r.buf, data)
+	r.offset += int64(n)
 	return err
 }
 
+// recordChunk bounds how much readGrowing allocates ahead of the data.
+const recordChunk = 1 << 20
+
+// readGrowing reads n bytes into a new buffer that grows as the data
+// arrives, so a huge length in a truncated file costs no more memory than
+// the file holds.
+func (r *Reader) readGrowing(n uint32) ([]byte, error) {
+	if n <= recordChunk {
+		data := make([]byte, n)
+		return data, r.read(data)
+	}
+	data := make([]byte, 0, recordChunk)
+	for uint32(len(data)) < n {
+		chunk := n - uint32(len(data))
+		if chunk > recordChunk {
+			chunk = recordChunk
+		}
+		start := len(data)
+		data = append(data, make([]byte, chunk)...)
+		if err := r.read(data[start:]); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
 func (r *Reader) readUint32() uint32 {
 	data := r.fourBytes
 	if r.err = r.read(data); r.err != nil {
@@ -126,41 +531,240 @@ func (r *Reader) readUint16() uint16 {
 
 // Writer writes a pcap file.
 type Writer struct {
-	writer io.Writer
-	buf    []byte
+	writer  io.Writer
+	flusher interface{ Flush() error } // the underlying writer, if buffered
+	buf     []byte
+	nsec    bool
+	order   binary.ByteOrder
+	recLen  int
+	limit   uint32
+	packets uint64
+	bytes   int64
+	closed  bool
+
+	gz         *gzip.Writer
+	flushEvery time.Duration
+	lastFlush  time.Time
+}
+
+var errWriterClosed = errors.New("pcap: write to closed Writer")
+
+// WriterOptions controls the output of a Writer.
+type WriterOptions struct {
+	// Precision selects microsecond or nanosecond timestamps and the
+	// matching magic number. The default follows header.MagicNumber.
+	Precision TimePrecision
+
+	// Gzip compresses the output. Compressed data is flushed to the
+	// underlying writer every FlushInterval (one second if zero, never if
+	// negative), so a partly written file can be read up to the last
+	// flush. The interval is only checked when a packet is written: while
+	// no packets arrive, call Flush to push out the last ones. Close must
+	// be called to finish the stream.
+	Gzip          bool
+	FlushInterval time.Duration
+
+	// BigEndian writes a big-endian file instead of a little-endian one.
+	// Together with Reader.BigEndian it allows byte-identical copies.
+	BigEndian bool
+
+	// Append continues a file that already has its header: only records
+	// are written. The header and options must match the existing file.
+	Append bool
+}
+
+// DefaultFileHeader returns the header NewWriter uses for a nil header:
+// version 2.4 with microsecond timestamps, MAXIMUM_SNAPLEN and Ethernet.
+func DefaultFileHeader() FileHeader {
+	return FileHeader{
+		MagicNumber:  TCPDUMP_MAGIC,
+		VersionMajor: 2,
+		VersionMinor: 4,
+		SnapLen:      MAXIMUM_SNAPLEN,
+		LinkType:     LINKTYPE_ETHERNET,
+	}
 }
 
 // NewWriter creates a Writer that stores output in an io.Writer.
-// The FileHeader is written immediately.
+// The FileHeader is written immediately. A nil header means
+// DefaultFileHeader.
 func NewWriter(writer io.Writer, header *FileHeader) (*Writer, error) {
+	return NewWriterOptions(writer, header, WriterOptions{})
+}
+
+// NewWriterOptions is like NewWriter with options.
+func NewWriterOptions(writer io.Writer, header *FileHeader, opts WriterOptions) (*Writer, error) {
+	if header == nil {
+		def := DefaultFileHeader()
+		header = &def
+	}
+	if err := header.validate(); err != nil {
+		return nil, err
+	}
 	w := &Writer{
 		writer: writer,
 		buf:    make([]byte, 24),
+		order:  binary.LittleEndian,
+		recLen: 16,
+		limit:  recordLimit(header),
+	}
+	w.flusher, _ = writer.(interface{ Flush() error })
+	if opts.BigEndian {
+		w.order = binary.BigEndian
+	}
+	if opts.Gzip {
+		w.gz = gzip.NewWriter(writer)
+		w.writer = w.gz
+		w.flushEvery = opts.FlushInterval
+		if w.flushEvery == 0 {
+			w.flushEvery = time.Second
+		}
+		w.lastFlush = time.Now()
+	}
+	magic := header.MagicNumber
+	switch opts.Precision {
+	case PrecisionMicro:
+		if nsecMagic(magic) {
+			magic = TCPDUMP_MAGIC
+		}
+	case PrecisionNano:
+		if !nsecMagic(magic) {
+			magic = NSEC_TCPDUMP_MAGIC
+		}
 	}
-	binary.LittleEndian.PutUint32(w.buf, header.MagicNumber)
-	binary.LittleEndian.PutUint16(w.buf[4:], header.VersionMajor)
-	binary.LittleEndian.PutUint16(w.buf[6:], header.VersionMinor)
-	binary.LittleEndian.PutUint32(w.buf[8:], uint32(header.TimeZone))
-	binary.LittleEndian.PutUint32(w.buf[12:], header.SigFigs)
-	binary.LittleEndian.PutUint32(w.buf[16:], header.SnapLen)
-	binary.LittleEndian.PutUint32(w.buf[20:], header.LinkType)
-	if _, err := writer.Write(w.buf); err != nil {
+	w.nsec = nsecMagic(magic)
+	if magic == KUZNETZOV_TCPDUMP_MAGIC {
+		w.recLen = 24
+	}
+	w.order.PutUint32(w.buf, magic)
+	w.order.PutUint16(w.buf[4:], header.VersionMajor)
+	w.order.PutUint16(w.buf[6:], header.VersionMinor)
+	w.order.PutUint32(w.buf[8:], uint32(header.TimeZone))
+	w.order.PutUint32(w.buf[12:], header.SigFigs)
+	w.order.PutUint32(w.buf[16:], header.SnapLen)
+	w.order.PutUint32(w.buf[20:], header.LinkType)
+	if opts.Append {
+		return w, nil
+	}
+	if _, err := w.writer.Write(w.buf); err != nil {
 		return nil, err
 	}
+	w.bytes = fileHeaderSize
 	return w, nil
 }
 
-// Writer writes a packet to the underlying writer.
+// validate checks that a Writer can write h: the magic number must be one
+// Reader accepts, and the link type must not use the reserved bits 16-25,
+// which are typically set by a byte-swapped value.
+func (h *FileHeader) validate() error {
+	if unsupportedMagic(h.MagicNumber) {
+		return fmt.Errorf("pcap: unsupported format: magic number %0x", h.MagicNumber)
+	}
+	if !knownMagic(h.MagicNumber) {
+		return fmt.Errorf("pcap: bad magic number: %0x", h.MagicNumber)
+	}
+	if h.LinkType&0x03ff0000 != 0 {
+		return fmt.Errorf("pcap: bad link type: %0x", h.LinkType)
+	}
+	return nil
+}
+
+// Writer writes a packet to the underlying writer. Data beyond the record
+// limit of the header, as for Reader, is cut off. The captured length is
+// taken from Data rather than Caplen, and the original length is raised to
+// it if smaller. pkt is not modified.
 func (w *Writer) Write(pkt *Packet) error {
-	binary.LittleEndian.PutUint32(w.buf, uint32(pkt.Time.Unix()))
-	binary.LittleEndian.PutUint32(w.buf[4:], uint32(pkt.Time.Nanosecond()))
-	binary.LittleEndian.PutUint32(w.buf[8:], pkt.Caplen)
-	binary.LittleEndian.PutUint32(w.buf[12:], pkt.Len)
-	if _, err := w.writer.Write(w.buf[:16]); err != nil {
+	if w.closed {
+		return errWriterClosed
+	}
+	data := pkt.Data
+	if uint32(len(data)) > w.limit {
+		data = data[:w.limit]
+	}
+	origLen := pkt.Len
+	if origLen < uint32(len(pkt.Data)) {
+		origLen = uint32(len(pkt.Data))
+	}
+	w.order.PutUint32(w.buf, uint32(pkt.Time.Unix()))
+	frac := pkt.Time.Nanosecond()
+	if !w.nsec {
+		frac /= 1000
+	}
+	w.order.PutUint32(w.buf[4:], uint32(frac))
+	w.order.PutUint32(w.buf[8:], uint32(len(data)))
+	w.order.PutUint32(w.buf[12:], origLen)
+	if w.recLen == 24 {
+		w.order.PutUint32(w.buf[16:], uint32(pkt.IfIndex))
+		w.order.PutUint16(w.buf[20:], pkt.Protocol)
+		w.buf[22] = pkt.PktType
+		w.buf[23] = 0
+	}
+	if _, err := w.writer.Write(w.buf[:w.recLen]); err != nil {
 		return err
 	}
-	_, err := w.writer.Write(pkt.Data)
-	return err
+	if _, err := w.writer.Write(data); err != nil {
+		return err
+	}
+	w.packets++
+	w.bytes += int64(w.recLen + len(data))
+	if w.gz != nil && w.flushEvery > 0 && time.Since(w.lastFlush) >= w.flushEvery {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Written returns the number of packets written and the size of the pcap
+// data written so far, including any file header, before compression.
+func (w *Writer) Written() (packets uint64, bytes int64) {
+	return w.packets, w.bytes
+}
+
+// Flush writes buffered compressed data to the underlying writer, and
+// flushes the underlying writer if it has a Flush method, like
+// bufio.Writer.
+func (w *Writer) Flush() error {
+	if w.gz != nil {
+		w.lastFlush = time.Now()
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	if w.flusher != nil {
+		return w.flusher.Flush()
+	}
+	return nil
+}
+
+// Close finishes a compressed stream and flushes the underlying writer
+// like Flush. It does not close the underlying writer. Write fails after
+// Close; further calls to Close do nothing.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if w.flusher != nil {
+		return w.flusher.Flush()
+	}
+	return nil
+}
+
+// gunzip returns a gzip reader for br if its data starts with the gzip
+// magic bytes, or nil.
+func gunzip(br *bufio.Reader) (*gzip.Reader, error) {
+	if b, _ := br.Peek(2); len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		return nil, nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("pcap: gzip: %w", err)
+	}
+	return gz, nil
 }
 
 func asUint32(data []byte, flip bool) uint32 {
@@ -170,6 +774,10 @@ func asUint32(data []byte, flip bool) uint32 {
 	return binary.LittleEndian.Uint32(data)
 }
 
+func swap32(v uint32) uint32 {
+	return v>>24 | v>>8&0xff00 | v<<8&0xff0000 | v<<24
+}
+
 func asUint16(data []byte, flip bool) uint16 {
 	if flip {
 		return binary.BigEndian.Uint16(data)
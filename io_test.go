@@ -0,0 +1,462 @@
+package pcap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPcapFile = "test/pcap_files/Network_Join_Nokia_Mobile.pcap"
+
+func testHeader() *FileHeader {
+	return &FileHeader{MagicNumber: TCPDUMP_MAGIC, VersionMajor: 2, VersionMinor: 4, SnapLen: 65535, LinkType: LINKTYPE_ETHERNET}
+}
+
+func TestReaderWriterCopy(t *testing.T) {
+	orig, err := ioutil.ReadFile(testPcapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(orig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	w, err := NewWriter(&out, &r.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pkt := r.Next(); pkt != nil; pkt = r.Next() {
+		if err := w.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(orig, out.Bytes()) {
+		t.Fatal("copy differs from original")
+	}
+}
+
+func TestWriterPrecision(t *testing.T) {
+	ts := time.Unix(1500000000, 123456789)
+	for _, tc := range []struct {
+		prec  TimePrecision
+		magic uint32
+		want  time.Time
+	}{
+		{PrecisionHeader, TCPDUMP_MAGIC, ts.Truncate(time.Microsecond)},
+		{PrecisionMicro, TCPDUMP_MAGIC, ts.Truncate(time.Microsecond)},
+		{PrecisionNano, NSEC_TCPDUMP_MAGIC, ts},
+	} {
+		var buf bytes.Buffer
+		w, err := NewWriterOptions(&buf, testHeader(), WriterOptions{Precision: tc.prec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(udpPacket(ts, 1, 2, 1, 2, nil))
+		if magic := binary.LittleEndian.Uint32(buf.Bytes()); magic != tc.magic {
+			t.Errorf("precision %d: magic %x", tc.prec, magic)
+		}
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Header.MagicNumber != tc.magic {
+			t.Errorf("precision %d: read magic %x", tc.prec, r.Header.MagicNumber)
+		}
+		if pkt := r.Next(); pkt == nil || !pkt.Time.Equal(tc.want) {
+			t.Errorf("precision %d: packet %v, want time %s", tc.prec, pkt, tc.want)
+		}
+	}
+}
+
+func TestWriterSnapLen(t *testing.T) {
+	var buf bytes.Buffer
+	h := testHeader()
+	h.SnapLen = 60
+	w, _ := NewWriter(&buf, h)
+	pkt := udpPacket(time.Unix(1500000000, 0), 1, 2, 3, 53, make([]byte, 100))
+	orig := *pkt
+	short := udpPacket(time.Unix(1500000001, 0), 1, 2, 3, 53, nil)
+	short.Caplen, short.Len = 1000, 10
+	for _, p := range []*Packet{pkt, short} {
+		if err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pkt.Caplen != orig.Caplen || len(pkt.Data) != len(orig.Data) {
+		t.Fatal("Write modified the packet")
+	}
+	if n, size := w.Written(); n != 2 || size != int64(buf.Len()) {
+		t.Fatalf("Written %d, %d; want 2, %d", n, size, buf.Len())
+	}
+
+	r, _ := NewReader(&buf)
+	got := r.Next()
+	if got == nil || got.Caplen != 60 || len(got.Data) != 60 || got.Len != orig.Len {
+		t.Fatalf("got %+v, want 60 of %d bytes", got, orig.Len)
+	}
+	got = r.Next()
+	if got == nil || int(got.Caplen) != len(short.Data) || got.Len != got.Caplen {
+		t.Fatalf("got %+v, want caplen and len %d", got, len(short.Data))
+	}
+}
+
+func TestWriterHeader(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewWriter(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(&buf)
+	if err != nil || r.Header != DefaultFileHeader() {
+		t.Fatalf("got %+v, err %v; want %+v", r.Header, err, DefaultFileHeader())
+	}
+	for _, h := range []FileHeader{
+		{VersionMajor: 2, VersionMinor: 4, SnapLen: 65535, LinkType: LINKTYPE_ETHERNET},
+		{MagicNumber: swap32(TCPDUMP_MAGIC), VersionMajor: 2, VersionMinor: 4, SnapLen: 65535},
+		{MagicNumber: TCPDUMP_MAGIC, VersionMajor: 2, VersionMinor: 4, SnapLen: 65535, LinkType: swap32(LINKTYPE_ETHERNET)},
+	} {
+		if _, err := NewWriter(&buf, &h); err == nil {
+			t.Errorf("header %+v accepted", h)
+		}
+	}
+}
+
+func TestWriterClose(t *testing.T) {
+	var out bytes.Buffer
+	buf := bufio.NewWriter(&out)
+	w, _ := NewWriter(buf, testHeader())
+	pkt := udpPacket(time.Unix(1500000000, 0), 1, 2, 3, 53, nil)
+	w.Write(pkt)
+	if out.Len() != 0 {
+		t.Fatal("bufio.Writer flushed early")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := fileHeaderSize + 16 + len(pkt.Data); out.Len() != want {
+		t.Fatalf("%d bytes flushed, want %d", out.Len(), want)
+	}
+	if err := w.Write(pkt); err == nil {
+		t.Fatal("Write after Close succeeded")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderBigEndianNsec(t *testing.T) {
+	var b []byte
+	for _, v := range []uint32{NSEC_TCPDUMP_MAGIC, 2<<16 | 4, 0, 0, 65535, LINKTYPE_RAW, 1500000000, 999999999, 4, 4} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	b = append(b, 0x45, 0, 0, 4)
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header.MagicNumber != NSEC_TCPDUMP_MAGIC || r.Header.VersionMajor != 2 || r.Header.LinkType != LINKTYPE_RAW {
+		t.Fatalf("header %+v", r.Header)
+	}
+	pkt := r.Next()
+	if pkt == nil || !pkt.Time.Equal(time.Unix(1500000000, 999999999)) || pkt.Caplen != 4 {
+		t.Fatalf("packet %+v", pkt)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, &FileHeader{MagicNumber: TCPDUMP_MAGIC, VersionMajor: 2, VersionMinor: 4, SnapLen: 65535, LinkType: LINKTYPE_LINUX_SLL})
+	w.Write(udpPacket(time.Unix(1, 0), 1, 2, 1, 2, nil))
+	data := buf.Bytes()
+
+	r, _ := NewReader(bytes.NewReader(data))
+	pkt, err := r.ReadPacket()
+	if err != nil || pkt.LinkType != LINKTYPE_LINUX_SLL {
+		t.Fatalf("packet %+v err %v", pkt, err)
+	}
+	if _, err := r.ReadPacket(); err != io.EOF || r.Err() != nil {
+		t.Fatalf("clean end: %v, Err %v", err, r.Err())
+	}
+
+	r, _ = NewReader(bytes.NewReader(data[:len(data)-5]))
+	_, err = r.ReadPacket()
+	var rerr *ReadError
+	if !errors.As(err, &rerr) || !errors.Is(err, io.ErrUnexpectedEOF) || rerr.Offset != 24 || r.Err() != err {
+		t.Fatalf("truncated record: %v", err)
+	}
+
+	if _, err := NewReader(bytes.NewReader(data[:10])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated header: %v", err)
+	}
+}
+
+func TestReaderRecordLimit(t *testing.T) {
+	var b []byte
+	for _, v := range []uint32{TCPDUMP_MAGIC, 2 | 4<<16, 0, 0, 1500, LINKTYPE_ETHERNET, 1, 0, 0xfffffff0, 0xfffffff0} {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rerr *ReadError
+	if _, err := r.ReadPacket(); !errors.As(err, &rerr) || rerr.Offset != 24 {
+		t.Fatalf("oversized record: %v", err)
+	}
+
+	r, _ = NewReader(bytes.NewReader(b))
+	r.MaxRecordSize = 0xfffffff0
+	if _, err := r.ReadPacket(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("oversized record with override: %v", err)
+	}
+}
+
+func TestReaderLenient(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, testHeader())
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < 5; i++ {
+		w.Write(udpPacket(start.Add(time.Duration(i)*time.Second), 1, 2, uint16(i), 2, nil))
+	}
+	data := buf.Bytes()
+	rec := 16 + 42
+	// Garbage between the first and second record, a bogus fourth record
+	// header and a truncated last record.
+	var bad []byte
+	bad = append(bad, data[:24+rec]...)
+	bad = append(bad, 0xde, 0xad, 0xbe, 0xef, 0xff, 0xff, 0xff, 0xff, 0xff)
+	bad = append(bad, data[24+rec:24+3*rec]...)
+	bad = append(bad, bytes.Repeat([]byte{0xff}, 16)...)
+	bad = append(bad, data[24+3*rec+16:len(data)-10]...)
+
+	r, _ := NewReader(bytes.NewReader(bad))
+	for pkt := r.Next(); pkt != nil; pkt = r.Next() {
+	}
+	if r.Err() == nil {
+		t.Fatal("strict reader accepted corrupt file")
+	}
+
+	r, _ = NewReader(bytes.NewReader(bad))
+	r.Lenient = true
+	var skips []Skip
+	r.OnSkip = func(s Skip) { skips = append(skips, s) }
+	var ports []uint16
+	for pkt := r.Next(); pkt != nil; pkt = r.Next() {
+		key, _ := FlowKeyOf(pkt)
+		ports = append(ports, key.PortA)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("lenient reader failed: %v", err)
+	}
+	if len(ports) != 3 || ports[0] != 0 || ports[1] != 1 || ports[2] != 2 {
+		t.Fatalf("lenient reader returned packets from ports %v", ports)
+	}
+	if n, _ := r.Skipped(); n != 3 || len(skips) != 3 || skips[0].Offset != int64(24+rec) || skips[0].Bytes != 9 {
+		t.Fatalf("skips %+v", skips)
+	}
+}
+
+func TestReaderReadPacketInto(t *testing.T) {
+	data, err := ioutil.ReadFile(testPcapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := NewReader(bytes.NewReader(data))
+	into, _ := NewReader(bytes.NewReader(data))
+	zero, _ := NewReader(bytes.NewReader(data))
+	zero.ZeroCopy = true
+	var pkt, zpkt *Packet
+	buf := make([]byte, 0, 64)
+	for {
+		w := want.Next()
+		pkt, err = into.ReadPacketInto(pkt, buf)
+		if w == nil {
+			if err != io.EOF {
+				t.Fatalf("ReadPacketInto at end: %v", err)
+			}
+			break
+		}
+		zpkt, _ = zero.ReadPacketInto(zpkt, nil)
+		for _, p := range []*Packet{pkt, zpkt} {
+			if p == nil || !p.Time.Equal(w.Time) || p.Len != w.Len || p.LinkType != w.LinkType || !bytes.Equal(p.Data, w.Data) {
+				t.Fatalf("got %+v, want %+v", p, w)
+			}
+		}
+		if len(w.Data) <= cap(buf) && &pkt.Data[0] != &buf[:1][0] {
+			t.Fatal("ReadPacketInto did not use buf")
+		}
+	}
+}
+
+// benchFile returns a pcap file of n small UDP packets.
+func benchFile(b *testing.B, n int) []byte {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, testHeader())
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < n; i++ {
+		w.Write(udpPacket(start.Add(time.Duration(i)*time.Millisecond), 1, 2, uint16(i), 53, make([]byte, 100)))
+	}
+	return buf.Bytes()
+}
+
+// benchRead reads b.N packets with next, starting over at end of file.
+func benchRead(b *testing.B, setup func(*Reader), next func(*Reader) bool) {
+	data := benchFile(b, 10000)
+	b.SetBytes(int64(len(data)) / 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var r *Reader
+	for i := 0; i < b.N; i++ {
+		if r == nil || !next(r) {
+			b.StopTimer()
+			r, _ = NewReader(bytes.NewReader(data))
+			setup(r)
+			b.StartTimer()
+			next(r)
+		}
+	}
+}
+
+func BenchmarkReaderNext(b *testing.B) {
+	benchRead(b, func(*Reader) {}, func(r *Reader) bool {
+		return r.Next() != nil
+	})
+}
+
+func BenchmarkReaderReadPacketInto(b *testing.B) {
+	var pkt *Packet
+	buf := make([]byte, MAXIMUM_SNAPLEN)
+	benchRead(b, func(*Reader) {}, func(r *Reader) bool {
+		var err error
+		pkt, err = r.ReadPacketInto(pkt, buf)
+		return err == nil
+	})
+}
+
+func BenchmarkReaderZeroCopy(b *testing.B) {
+	var pkt *Packet
+	benchRead(b, func(r *Reader) { r.ZeroCopy = true }, func(r *Reader) bool {
+		var err error
+		pkt, err = r.ReadPacketInto(pkt, nil)
+		return err == nil
+	})
+}
+
+func TestGzip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriterOptions(&buf, testHeader(), WriterOptions{Gzip: true, FlushInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < 10; i++ {
+		w.Write(udpPacket(start.Add(time.Duration(i)*time.Second), 1, 2, uint16(i), 53, nil))
+	}
+	if buf.Len() > 24 {
+		t.Fatalf("%d bytes written before a flush", buf.Len())
+	}
+	count := func(data []byte) int {
+		r, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for pkt := r.Next(); pkt != nil; pkt = r.Next() {
+			n++
+		}
+		return n
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(buf.Bytes()); n != 10 {
+		t.Fatalf("read %d packets after flush", n)
+	}
+	w.Write(udpPacket(start.Add(10*time.Second), 1, 2, 10, 53, nil))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(buf.Bytes()); n != 11 {
+		t.Fatalf("read %d packets after close", n)
+	}
+	r, _ := NewReader(bytes.NewReader(buf.Bytes()))
+	if err := r.SeekPacket(1); err == nil {
+		t.Fatal("seek in compressed file succeeded")
+	}
+
+	var ng bytes.Buffer
+	gz := gzip.NewWriter(&ng)
+	gz.Write(buildNgFile(binary.LittleEndian))
+	gz.Close()
+	nr, err := NewNgReader(&ng)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt := nr.Next(); pkt == nil {
+		t.Fatalf("compressed pcapng: %v", nr.Err())
+	}
+}
+
+func TestReaderRecordFormats(t *testing.T) {
+	for _, tc := range []struct {
+		magic uint32
+		order binary.AppendByteOrder
+		extra []byte
+		nsec  bool
+	}{
+		{KUZNETZOV_TCPDUMP_MAGIC, binary.LittleEndian, []byte{3, 0, 0, 0, 0x08, 0x00, 4, 0}, false},
+		{KUZNETZOV_TCPDUMP_MAGIC, binary.BigEndian, []byte{0, 0, 0, 3, 0x00, 0x08, 4, 0}, false},
+		{NAVTEL_TCPDUMP_MAGIC, binary.LittleEndian, nil, true},
+	} {
+		var b []byte
+		for _, v := range []uint32{tc.magic, 2<<16 | 4, 0, 0, 65535, LINKTYPE_RAW, 1500000000, 5000, 4, 4} {
+			b = tc.order.AppendUint32(b, v)
+		}
+		if tc.order == binary.LittleEndian {
+			// The version fields are two 16-bit words.
+			b[4], b[5], b[6], b[7] = 2, 0, 4, 0
+		}
+		b = append(b, tc.extra...)
+		b = append(b, 0x45, 0, 0, 4)
+		r, err := NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("magic %x: %v", tc.magic, err)
+		}
+		pkt := r.Next()
+		want := time.Unix(1500000000, 5000*1000)
+		if tc.nsec {
+			want = time.Unix(1500000000, 5000)
+		}
+		if pkt == nil || !pkt.Time.Equal(want) || !bytes.Equal(pkt.Data, []byte{0x45, 0, 0, 4}) {
+			t.Fatalf("magic %x: packet %+v, err %v", tc.magic, pkt, r.Err())
+		}
+		if tc.extra != nil && (pkt.IfIndex != 3 || pkt.Protocol != 8 || pkt.PktType != 4) {
+			t.Fatalf("magic %x: extra fields %d %d %d", tc.magic, pkt.IfIndex, pkt.Protocol, pkt.PktType)
+		}
+
+		var out bytes.Buffer
+		w, _ := NewWriterOptions(&out, &r.Header, WriterOptions{BigEndian: r.BigEndian()})
+		w.Write(pkt)
+		if !bytes.Equal(out.Bytes(), b) {
+			t.Fatalf("magic %x: copy differs\n%x\n%x", tc.magic, out.Bytes(), b)
+		}
+	}
+
+	for _, order := range []binary.AppendByteOrder{binary.LittleEndian, binary.BigEndian} {
+		b := order.AppendUint32(nil, FMESQUITA_TCPDUMP_MAGIC)
+		b = append(b, make([]byte, 20)...)
+		if _, err := NewReader(bytes.NewReader(b)); err == nil || !strings.Contains(err.Error(), "unsupported format") {
+			t.Fatalf("FMESQUITA_TCPDUMP_MAGIC accepted: %v", err)
+		}
+	}
+	if _, err := NewWriter(ioutil.Discard, &FileHeader{MagicNumber: FMESQUITA_TCPDUMP_MAGIC}); err == nil {
+		t.Fatal("Writer accepted FMESQUITA_TCPDUMP_MAGIC")
+	}
+}
@@ -0,0 +1,270 @@
+package pcap
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// LinkTypeMode tells Merge what to do with inputs of different link types.
+type LinkTypeMode int
+
+const (
+	LinkTypeFail    LinkTypeMode = iota // all inputs must have the same link type
+	LinkTypeConvert                     // convert LINKTYPE_RAW and LINKTYPE_LINUX_SLL to Ethernet
+)
+
+// MergeOptions controls a Merger.
+type MergeOptions struct {
+	LinkTypes LinkTypeMode
+
+	// Append concatenates the inputs in the given order instead of
+	// merging them by packet time, like mergecap -a.
+	Append bool
+}
+
+// Merger combines several pcap inputs into one stream ordered by
+// Packet.Time, like mergecap. Packets with equal times come in input
+// order. It implements PacketSource.
+type Merger struct {
+	readers []*Reader
+	files   []*os.File
+	opts    MergeOptions
+	header  FileHeader
+	convert bool
+
+	h    mergeHeap
+	next int // input being appended
+	err  error
+}
+
+// Merge returns a Merger over readers.
+func Merge(readers []*Reader, opts MergeOptions) (*Merger, error) {
+	if len(readers) == 0 {
+		return nil, errors.New("pcap: nothing to merge")
+	}
+	m := &Merger{readers: readers, opts: opts, header: readers[0].Header}
+	m.header.MagicNumber = TCPDUMP_MAGIC
+	var other uint32
+	var nsec, kuznetzov bool
+	for _, r := range readers {
+		if r.Header.LinkType != m.header.LinkType {
+			m.convert = true
+			other = r.Header.LinkType
+		}
+		if r.Header.SnapLen > m.header.SnapLen {
+			m.header.SnapLen = r.Header.SnapLen
+		}
+		nsec = nsec || r.Header.Precision() == PrecisionNano
+		kuznetzov = kuznetzov || r.Header.MagicNumber == KUZNETZOV_TCPDUMP_MAGIC
+	}
+	// The extended records of Kuznetzov inputs are kept, but they only
+	// have microsecond timestamps.
+	switch {
+	case nsec && kuznetzov:
+		return nil, errors.New("pcap: cannot merge nanosecond and Kuznetzov inputs")
+	case nsec:
+		m.header.MagicNumber = NSEC_TCPDUMP_MAGIC
+	case kuznetzov:
+		m.header.MagicNumber = KUZNETZOV_TCPDUMP_MAGIC
+	}
+	if m.convert {
+		if opts.LinkTypes != LinkTypeConvert {
+			return nil, fmt.Errorf("pcap: cannot merge link types %d and %d without conversion", m.header.LinkType, other)
+		}
+		for i, r := range readers {
+			switch r.Header.LinkType {
+			case LINKTYPE_ETHERNET, LINKTYPE_RAW, LINKTYPE_LINUX_SLL:
+			default:
+				return nil, fmt.Errorf("pcap: cannot convert link type %d of input %d to Ethernet", r.Header.LinkType, i)
+			}
+		}
+		m.header.LinkType = LINKTYPE_ETHERNET
+		// toEthernet adds up to 14 bytes to a packet.
+		m.header.SnapLen += 14
+	}
+	if !opts.Append {
+		for i := range readers {
+			if !m.push(i) {
+				break
+			}
+		}
+	}
+	return m, nil
+}
+
+// MergeFiles opens the pcap files at paths and merges them. Close closes
+// the files.
+func MergeFiles(paths []string, opts MergeOptions) (*Merger, error) {
+	var files []*os.File
+	var readers []*Reader
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+		r, err := NewReader(bufio.NewReader(f))
+		if err != nil {
+			closeFiles(files)
+			return nil, fmt.Errorf("pcap: %s: %w", path, err)
+		}
+		readers = append(readers, r)
+	}
+	m, err := Merge(readers, opts)
+	if err != nil {
+		closeFiles(files)
+		return nil, err
+	}
+	m.files = files
+	return m, nil
+}
+
+func closeFiles(files []*os.File) error {
+	var err error
+	for _, f := range files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Header returns the file header for writing the merged stream: the first
+// input's header with the largest snaplen, raised by the Ethernet header
+// when converting, nanosecond precision if any input has it, the
+// Kuznetzov format if any input has it, and the link type after
+// conversion.
+func (m *Merger) Header() FileHeader {
+	return m.header
+}
+
+// Next returns the next packet, or nil when all inputs are exhausted or an
+// input failed.
+func (m *Merger) Next() *Packet {
+	if m.err != nil {
+		return nil
+	}
+	var pkt *Packet
+	if m.opts.Append {
+		for pkt == nil && m.next < len(m.readers) {
+			if pkt = m.readers[m.next].Next(); pkt == nil {
+				if m.fail(m.next) {
+					return nil
+				}
+				m.next++
+			}
+		}
+	} else if len(m.h) > 0 {
+		it := m.h[0]
+		pkt = it.pkt
+		if !m.refill(it.src) {
+			return nil
+		}
+	}
+	if pkt == nil {
+		return nil
+	}
+	if m.convert {
+		if err := toEthernet(pkt); err != nil {
+			m.err = err
+			return nil
+		}
+	}
+	return pkt
+}
+
+// Err returns the error that ended the stream, or nil.
+func (m *Merger) Err() error {
+	return m.err
+}
+
+// Close closes the files opened by MergeFiles.
+func (m *Merger) Close() error {
+	files := m.files
+	m.files = nil
+	return closeFiles(files)
+}
+
+// push reads the next packet of input i onto the heap.
+func (m *Merger) push(i int) bool {
+	pkt := m.readers[i].Next()
+	if pkt == nil {
+		return !m.fail(i)
+	}
+	heap.Push(&m.h, mergeItem{pkt, i})
+	return true
+}
+
+// refill replaces the head of the heap, from input i, with its successor.
+func (m *Merger) refill(i int) bool {
+	pkt := m.readers[i].Next()
+	if pkt == nil {
+		heap.Pop(&m.h)
+		return !m.fail(i)
+	}
+	m.h[0].pkt = pkt
+	heap.Fix(&m.h, 0)
+	return true
+}
+
+// fail records the error of exhausted input i, if any.
+func (m *Merger) fail(i int) bool {
+	if err := m.readers[i].Err(); err != nil {
+		m.err = fmt.Errorf("pcap: merge input %d: %w", i, err)
+		return true
+	}
+	return false
+}
+
+// toEthernet rewrites a LINKTYPE_RAW or LINKTYPE_LINUX_SLL packet as an
+// Ethernet frame. The source address of a cooked header is kept when it is
+// a MAC address.
+func toEthernet(pkt *Packet) error {
+	if pkt.LinkType == LINKTYPE_ETHERNET {
+		return nil
+	}
+	etherType, payload, ok := linkPayload(pkt)
+	if !ok {
+		return fmt.Errorf("pcap: cannot convert packet of link type %d at %s", pkt.LinkType, pkt.Time)
+	}
+	data := make([]byte, 14+len(payload))
+	if pkt.LinkType == LINKTYPE_LINUX_SLL && binary.BigEndian.Uint16(pkt.Data[4:6]) == 6 {
+		copy(data[6:12], pkt.Data[6:12])
+	}
+	binary.BigEndian.PutUint16(data[12:14], uint16(etherType))
+	copy(data[14:], payload)
+	delta := uint32(len(data) - len(pkt.Data))
+	pkt.Data = data
+	pkt.Caplen += delta
+	pkt.Len += delta
+	pkt.LinkType = LINKTYPE_ETHERNET
+	return nil
+}
+
+type mergeItem struct {
+	pkt *Packet
+	src int
+}
+
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].pkt.Time.Equal(h[j].pkt.Time) {
+		return h[i].src < h[j].src
+	}
+	return h[i].pkt.Time.Before(h[j].pkt.Time)
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,164 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mergeInput returns a pcap file with packets from ports at the given
+// seconds, on link type Ethernet, raw IP or Linux cooked.
+func mergeInput(linkType uint32, ports []uint16, secs []int) []byte {
+	var buf bytes.Buffer
+	h := testHeader()
+	h.LinkType = linkType
+	w, _ := NewWriter(&buf, h)
+	for i, port := range ports {
+		pkt := udpPacket(time.Unix(int64(secs[i]), 0), 1, 2, port, 53, nil)
+		switch linkType {
+		case LINKTYPE_RAW:
+			pkt.Data = pkt.Data[14:]
+		case LINKTYPE_LINUX_SLL:
+			sll := make([]byte, 16, 16+len(pkt.Data)-14)
+			binary.BigEndian.PutUint16(sll[4:6], 6)
+			copy(sll[6:12], []byte{2, 0, 0, 0, 0, 1})
+			binary.BigEndian.PutUint16(sll[14:16], TYPE_IP)
+			pkt.Data = append(sll, pkt.Data[14:]...)
+		}
+		pkt.Caplen = uint32(len(pkt.Data))
+		pkt.Len = pkt.Caplen
+		w.Write(pkt)
+	}
+	return buf.Bytes()
+}
+
+func mergePorts(t *testing.T, m *Merger) []int {
+	var ports []int
+	for pkt := m.Next(); pkt != nil; pkt = m.Next() {
+		key, ok := FlowKeyOf(pkt)
+		if !ok || pkt.LinkType != int(m.Header().LinkType) || int(pkt.Caplen) != len(pkt.Data) {
+			t.Fatalf("bad merged packet %+v", pkt)
+		}
+		ports = append(ports, int(key.PortA))
+	}
+	if m.Err() != nil {
+		t.Fatal(m.Err())
+	}
+	return ports
+}
+
+func TestMerge(t *testing.T) {
+	a := mergeInput(LINKTYPE_ETHERNET, []uint16{1, 3, 5}, []int{1, 3, 5})
+	b := mergeInput(LINKTYPE_ETHERNET, []uint16{2, 4, 6, 7}, []int{2, 4, 5, 7})
+	readers := func(files ...[]byte) []*Reader {
+		var rs []*Reader
+		for _, f := range files {
+			r, _ := NewReader(bytes.NewReader(f))
+			rs = append(rs, r)
+		}
+		return rs
+	}
+	m, err := Merge(readers(a, b), MergeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mergePorts(t, m); !equalInts(got, []int{1, 2, 3, 4, 5, 6, 7}) {
+		t.Fatalf("merged %v", got)
+	}
+	m, _ = Merge(readers(b, a), MergeOptions{Append: true})
+	if got := mergePorts(t, m); !equalInts(got, []int{2, 4, 6, 7, 1, 3, 5}) {
+		t.Fatalf("appended %v", got)
+	}
+
+	raw := mergeInput(LINKTYPE_RAW, []uint16{10}, []int{0})
+	sll := mergeInput(LINKTYPE_LINUX_SLL, []uint16{11}, []int{6})
+	if _, err := Merge(readers(a, raw), MergeOptions{}); err == nil {
+		t.Fatal("merged different link types without conversion")
+	}
+	m, err = Merge(readers(a, raw, sll), MergeOptions{LinkTypes: LinkTypeConvert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mergePorts(t, m); !equalInts(got, []int{10, 1, 3, 5, 11}) {
+		t.Fatalf("converted %v", got)
+	}
+
+	dir := t.TempDir()
+	var paths []string
+	for i, f := range [][]byte{a, b, a[:len(a)-3]} {
+		paths = append(paths, filepath.Join(dir, string(rune('a'+i))+".pcap"))
+		os.WriteFile(paths[i], f, 0644)
+	}
+	m, err = MergeFiles(paths, MergeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	for pkt := m.Next(); pkt != nil; pkt = m.Next() {
+	}
+	if m.Err() == nil {
+		t.Fatal("truncated input not reported")
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMergeHeader(t *testing.T) {
+	input := func(magic uint32, linkType uint32, ifIndex int32) *Reader {
+		var buf bytes.Buffer
+		h := testHeader()
+		h.MagicNumber, h.LinkType, h.SnapLen = magic, linkType, 100
+		w, _ := NewWriter(&buf, h)
+		pkt := udpPacket(time.Unix(1, 0), 1, 2, 1, 53, nil)
+		if linkType == LINKTYPE_RAW {
+			pkt.Data = pkt.Data[14:]
+		}
+		pkt.IfIndex = ifIndex
+		w.Write(pkt)
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	m, err := Merge([]*Reader{input(TCPDUMP_MAGIC, LINKTYPE_ETHERNET, 0), input(TCPDUMP_MAGIC, LINKTYPE_RAW, 0)}, MergeOptions{LinkTypes: LinkTypeConvert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := m.Header(); h.SnapLen != 114 {
+		t.Errorf("converted snaplen %d", h.SnapLen)
+	}
+	for pkt := m.Next(); pkt != nil; pkt = m.Next() {
+		if pkt.Caplen > m.Header().SnapLen {
+			t.Errorf("packet of %d bytes exceeds snaplen", pkt.Caplen)
+		}
+	}
+
+	m, err = Merge([]*Reader{input(KUZNETZOV_TCPDUMP_MAGIC, LINKTYPE_ETHERNET, 3), input(TCPDUMP_MAGIC, LINKTYPE_ETHERNET, 0)}, MergeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := m.Header(); h.MagicNumber != KUZNETZOV_TCPDUMP_MAGIC {
+		t.Errorf("merged magic %x", h.MagicNumber)
+	}
+	if pkt := m.Next(); pkt == nil || pkt.IfIndex != 3 {
+		t.Errorf("extended fields lost: %+v", pkt)
+	}
+	if _, err := Merge([]*Reader{input(KUZNETZOV_TCPDUMP_MAGIC, LINKTYPE_ETHERNET, 3), input(NSEC_TCPDUMP_MAGIC, LINKTYPE_ETHERNET, 0)}, MergeOptions{}); err == nil {
+		t.Error("merged Kuznetzov and nanosecond inputs")
+	}
+}
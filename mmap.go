@@ -0,0 +1,198 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MmapReader reads a classic pcap file mapped into memory. Packets point
+// into the read-only mapping instead of being copied, so their Data must
+// not be modified. Any number of MmapCursors can read disjoint record
+// ranges concurrently.
+type MmapReader struct {
+	Header FileHeader
+
+	data   []byte
+	flip   bool
+	nsec   bool
+	recLen int
+	limit  uint32
+}
+
+// OpenMmap maps the pcap file at path. Compressed files cannot be mapped.
+func OpenMmap(path string) (*MmapReader, error) {
+	data, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMmapReader(data)
+	if err != nil {
+		unmapFile(data)
+		return nil, err
+	}
+	return m, nil
+}
+
+func newMmapReader(data []byte) (*MmapReader, error) {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		return nil, errors.New("pcap: cannot map a compressed file")
+	}
+	head := data
+	if len(head) > fileHeaderSize {
+		head = head[:fileHeaderSize]
+	}
+	r, err := NewReader(bytes.NewReader(head))
+	if err != nil {
+		return nil, err
+	}
+	return &MmapReader{
+		Header: r.Header,
+		data:   data,
+		flip:   r.flip,
+		nsec:   r.nsec,
+		recLen: r.recLen,
+		limit:  recordLimit(&r.Header),
+	}, nil
+}
+
+// Close unmaps the file. Packets read from it must not be used afterwards.
+func (m *MmapReader) Close() error {
+	data := m.data
+	m.data = nil
+	return unmapFile(data)
+}
+
+// Size returns the size of the file.
+func (m *MmapReader) Size() int64 {
+	return int64(len(m.data))
+}
+
+// Cursor returns a cursor over all records.
+func (m *MmapReader) Cursor() *MmapCursor {
+	return m.Range(fileHeaderSize, m.Size())
+}
+
+// Range returns a cursor over the records from offset start up to offset
+// end. start must be a record boundary, such as an IndexEntry offset.
+func (m *MmapReader) Range(start, end int64) *MmapCursor {
+	if end > m.Size() {
+		end = m.Size()
+	}
+	return &MmapCursor{m: m, off: start, end: end}
+}
+
+// Split divides the records into at most n ranges of about equal size. It
+// walks the record headers to find the boundaries.
+func (m *MmapReader) Split(n int) ([]*MmapCursor, error) {
+	if n < 1 {
+		n = 1
+	}
+	var cursors []*MmapCursor
+	start, off := int64(fileHeaderSize), int64(fileHeaderSize)
+	step := (m.Size() - fileHeaderSize) / int64(n)
+	for off < m.Size() {
+		capLen, err := m.record(off)
+		if err != nil {
+			return nil, err
+		}
+		off += int64(m.recLen) + int64(capLen)
+		if len(cursors) < n-1 && off-start >= step {
+			cursors = append(cursors, m.Range(start, off))
+			start = off
+		}
+	}
+	if start < off || len(cursors) == 0 {
+		cursors = append(cursors, m.Range(start, off))
+	}
+	return cursors, nil
+}
+
+// record checks the record at off and returns its captured length.
+func (m *MmapReader) record(off int64) (uint32, error) {
+	if off+int64(m.recLen) > m.Size() {
+		return 0, &ReadError{off, fmt.Errorf("record header: %w", io.ErrUnexpectedEOF)}
+	}
+	capLen := asUint32(m.data[off+8:off+12], m.flip)
+	if capLen > m.limit {
+		return 0, &ReadError{off, fmt.Errorf("record length %d exceeds limit %d", capLen, m.limit)}
+	}
+	if off+int64(m.recLen)+int64(capLen) > m.Size() {
+		return 0, &ReadError{off, fmt.Errorf("record data: %w", io.ErrUnexpectedEOF)}
+	}
+	return capLen, nil
+}
+
+// MmapCursor reads a range of records of an MmapReader. A cursor must only
+// be used by one goroutine at a time.
+type MmapCursor struct {
+	m   *MmapReader
+	off int64
+	end int64
+	err error
+}
+
+// Next returns the next packet or nil at the end of the range or on error.
+// Its Data points into the mapping.
+func (c *MmapCursor) Next() *Packet {
+	pkt, _ := c.ReadPacketInto(nil)
+	return pkt
+}
+
+// Err returns the error that made Next return nil, or nil at the end of
+// the range.
+func (c *MmapCursor) Err() error {
+	if c.err == io.EOF {
+		return nil
+	}
+	return c.err
+}
+
+// Offset returns the file offset of the next record.
+func (c *MmapCursor) Offset() int64 {
+	return c.off
+}
+
+// ReadPacketInto is like Reader.ReadPacketInto, without a buffer: Data
+// points into the mapping. A nil pkt is allocated.
+func (c *MmapCursor) ReadPacketInto(pkt *Packet) (*Packet, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.off >= c.end {
+		c.err = io.EOF
+		return nil, c.err
+	}
+	m := c.m
+	capLen, err := m.record(c.off)
+	if err != nil {
+		c.err = err
+		return nil, err
+	}
+	if pkt == nil {
+		pkt = new(Packet)
+	} else {
+		*pkt = Packet{data: pkt.data, iphdr: pkt.iphdr, ip6hdr: pkt.ip6hdr, tcphdr: pkt.tcphdr}
+	}
+	d := m.data[c.off : c.off+int64(m.recLen)]
+	data := m.data[c.off+int64(m.recLen) : c.off+int64(m.recLen)+int64(capLen)]
+	c.off += int64(m.recLen) + int64(capLen)
+
+	frac := int64(asUint32(d[4:8], m.flip))
+	if !m.nsec {
+		frac *= 1000
+	}
+	pkt.Time = time.Unix(int64(asUint32(d[0:4], m.flip)), frac)
+	pkt.Caplen = capLen
+	pkt.Len = asUint32(d[12:16], m.flip)
+	pkt.Data = data[:capLen:capLen]
+	pkt.LinkType = int(m.Header.LinkType)
+	if m.recLen == 24 {
+		pkt.IfIndex = int32(asUint32(d[16:20], m.flip))
+		pkt.Protocol = asUint16(d[20:22], m.flip)
+		pkt.PktType = d[22]
+	}
+	return pkt, nil
+}
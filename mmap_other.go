@@ -0,0 +1,14 @@
+//go:build !linux
+
+package pcap
+
+import "os"
+
+// Without mmap the file is read into memory.
+func mapFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
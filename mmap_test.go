@@ -0,0 +1,96 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMmapReader(t *testing.T) {
+	data, err := os.ReadFile(testPcapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []*Packet
+	r, _ := NewReader(bytes.NewReader(data))
+	for pkt := r.Next(); pkt != nil; pkt = r.Next() {
+		want = append(want, pkt)
+	}
+
+	m, err := OpenMmap(testPcapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.Header != r.Header {
+		t.Fatalf("header %+v, want %+v", m.Header, r.Header)
+	}
+	same := func(got, w *Packet) bool {
+		return got.Time.Equal(w.Time) && got.Len == w.Len && got.LinkType == w.LinkType && bytes.Equal(got.Data, w.Data)
+	}
+	c := m.Cursor()
+	var pkt *Packet
+	for i := 0; ; i++ {
+		pkt, err = c.ReadPacketInto(pkt)
+		if err == io.EOF && i == len(want) {
+			break
+		}
+		if err != nil || i >= len(want) || !same(pkt, want[i]) {
+			t.Fatalf("packet %d: %+v, err %v", i, pkt, err)
+		}
+	}
+
+	// Concurrent cursors over disjoint ranges cover every packet once.
+	cursors, err := m.Split(3)
+	if err != nil || len(cursors) != 3 {
+		t.Fatalf("Split: %d cursors, err %v", len(cursors), err)
+	}
+	got := make([][]*Packet, len(cursors))
+	var wg sync.WaitGroup
+	for i, c := range cursors {
+		wg.Add(1)
+		go func(i int, c *MmapCursor) {
+			defer wg.Done()
+			for pkt := c.Next(); pkt != nil; pkt = c.Next() {
+				got[i] = append(got[i], pkt)
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	n := 0
+	for i, pkts := range got {
+		if cursors[i].Err() != nil || len(pkts) == 0 {
+			t.Fatalf("range %d: %d packets, err %v", i, len(pkts), cursors[i].Err())
+		}
+		for _, pkt := range pkts {
+			if !same(pkt, want[n]) {
+				t.Fatalf("range %d: packet %d differs", i, n)
+			}
+			n++
+		}
+	}
+	if n != len(want) {
+		t.Fatalf("ranges hold %d of %d packets", n, len(want))
+	}
+
+	path := filepath.Join(t.TempDir(), "short.pcap")
+	os.WriteFile(path, data[:len(data)-3], 0644)
+	short, err := OpenMmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer short.Close()
+	c = short.Cursor()
+	for pkt := c.Next(); pkt != nil; pkt = c.Next() {
+	}
+	if !errors.Is(c.Err(), io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated file: %v", c.Err())
+	}
+	if _, err := short.Split(2); err == nil {
+		t.Fatal("Split of a truncated file succeeded")
+	}
+}
@@ -24,6 +24,18 @@ type Packet struct {
 	Partial uint32    // partial bytes clipped
 	Seq     uint32    // pkt capture sequence number
 
+	FilterGen  uint32 // filter generation the packet was captured under
+	SampleRate uint32 // 1-in-N sampling applied before delivery, 0 if none
+
+	InterfaceID uint32 // pcapng interface the packet was captured on
+	Flags       uint32 // pcapng epb_flags, see NG_FLAG_*
+	Comment     string // pcapng opt_comment
+
+	// Extra record fields of KUZNETZOV_TCPDUMP_MAGIC files.
+	IfIndex  int32  // receiving interface index
+	Protocol uint16 // socket buffer protocol, as stored in the file
+	PktType  uint8  // Linux packet type, PACKET_HOST and so on
+
 	Data []byte // packet data
 
 	Type     int // protocol type, see LINKTYPE_*
@@ -42,6 +54,33 @@ type Packet struct {
 	tcphdr *Tcphdr
 }
 
+// Clone returns a copy of the packet metadata with its own copy of Data.
+// Decoded headers are not copied; call Decode on the clone if needed.
+// Packets from Pcap.NextEx point into buffers that libpcap reuses, so they
+// must be cloned before being kept.
+func (p *Packet) Clone() *Packet {
+	c := &Packet{
+		Time:        p.Time,
+		Caplen:      p.Caplen,
+		Len:         p.Len,
+		Partial:     p.Partial,
+		Seq:         p.Seq,
+		FilterGen:   p.FilterGen,
+		SampleRate:  p.SampleRate,
+		InterfaceID: p.InterfaceID,
+		Flags:       p.Flags,
+		Comment:     p.Comment,
+		IfIndex:     p.IfIndex,
+		Protocol:    p.Protocol,
+		PktType:     p.PktType,
+		Type:        p.Type,
+		LinkType:    p.LinkType,
+	}
+	c.Data = make([]byte, len(p.Data))
+	copy(c.Data, p.Data)
+	return c
+}
+
 func (p *Packet) setHeader(header interface{}) error {
 
 	if p.Headers_cnt >= len(p.Headers) {
@@ -63,7 +102,14 @@ func (p *Packet) IsRaw() bool {
 
 // Decode decodes the headers of a Packet.
 func (p *Packet) Decode() {
-	if p.IsRaw() == false {
+	if p.LinkType == LINKTYPE_LINUX_SLL {
+		// Linux cooked capture, the protocol is at the end of the 16 byte header.
+		if len(p.Data) < 16 {
+			return
+		}
+		p.Type = int(binary.BigEndian.Uint16(p.Data[14:16]))
+		p.Payload = p.Data[16:]
+	} else if p.IsRaw() == false {
 		p.Type = int(binary.BigEndian.Uint16(p.Data[12:14]))
 		p.DestMac = decodemac(p.Data[0:6])
 		p.SrcMac = decodemac(p.Data[6:12])
@@ -80,7 +126,7 @@ func (p *Packet) Decode() {
 		}
 	} else {
 		p.Type = TYPE_IP
-		if p.Data[0]&0xf0 == 6 {
+		if p.Data[0]>>4 == 6 {
 			p.Type = TYPE_IP6
 		}
 		p.Payload = p.Data[0:]
@@ -7,6 +7,8 @@ package pcap
 #include <pcap.h>
 #include <string.h>
 #include <ifaddrs.h>
+#include <unistd.h>
+#include <errno.h>
 
 #define MAX_PACKETS     10
 #define PCAP_DISPATCH_OVERFLOW 5
@@ -75,6 +77,41 @@ void hack_pcap_dump(pcap_dumper_t * dumper, struct pcap_pkthdr *pkt_header,
 {
     pcap_dump((u_char *)dumper, pkt_header, pkt_data);
 }
+int hack_pcap_dump_packet(pcap_dumper_t * dumper, long sec, long frac,
+		      bpf_u_int32 caplen, bpf_u_int32 len, u_char * pkt_data)
+{
+    struct pcap_pkthdr h;
+
+    h.ts.tv_sec = sec;
+    h.ts.tv_usec = frac;
+    h.caplen = caplen;
+    h.len = len;
+    pcap_dump((u_char *)dumper, &h, pkt_data);
+    return ferror(pcap_dump_file(dumper));
+}
+// Opens a savefile on a duplicate of fd, so that pcap_close leaves fd open.
+pcap_t *hack_pcap_fopen_offline(int fd, char *errbuf)
+{
+    FILE *fp;
+    pcap_t *p;
+    int nfd = dup(fd);
+
+    if (nfd < 0) {
+        snprintf(errbuf, PCAP_ERRBUF_SIZE, "dup: %s", strerror(errno));
+        return NULL;
+    }
+    fp = fdopen(nfd, "rb");
+    if (fp == NULL) {
+        snprintf(errbuf, PCAP_ERRBUF_SIZE, "fdopen: %s", strerror(errno));
+        close(nfd);
+        return NULL;
+    }
+    p = pcap_fopen_offline(fp, errbuf);
+    if (p == NULL) {
+        fclose(fp);
+    }
+    return p;
+}
 */
 import "C"
 
@@ -84,9 +121,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/lacework/agent/datacollector/dlog"
+	"io"
 	"io/ioutil"
 	"net"
+	"os"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -101,10 +141,24 @@ type Pcap struct {
 	seq     uint32
 	hdrsize int
 	IsRaw   bool
+	offline bool
+
+	// Filter generation bookkeeping, see filter.go. NextEx does not hold mu
+	// while it is blocked in pcap_dispatch, but sets reading.
+	mu          sync.Mutex
+	idle        *sync.Cond // signalled when a read or a filter swap ends
+	reading     bool
+	swapping    int  // ReplaceFilter calls waiting for the reader
+	filterBreak bool // a pcap_breakloop by ReplaceFilter is not yet seen
+	userBreak   bool // a pcap_breakloop by BreakLoop is not yet reported
+	gen         uint32
+	bufGen      uint32
+	filters     []*FilterStat
 }
 
 type PcapDumper struct {
 	cptr *C.pcap_dumper_t
+	nsec bool // the handle writes nanosecond timestamps
 }
 
 type pcapError struct{ string }
@@ -132,11 +186,18 @@ type IFAddress struct {
 	// TODO: add broadcast + PtP dst ?
 }
 
-func Version() string               { return C.GoString(C.pcap_lib_version()) }
-func (p *Pcap) Datalink() int       { return int(C.pcap_datalink(p.cptr)) }
-func (e *pcapError) Error() string  { return e.string }
-func (p *Pcap) Geterror() error     { return &pcapError{C.GoString(C.pcap_geterr(p.cptr))} }
-func (p *Pcap) Next() (pkt *Packet) { rv, _ := p.NextEx(nil); return rv }
+func Version() string              { return C.GoString(C.pcap_lib_version()) }
+func (p *Pcap) Datalink() int      { return int(C.pcap_datalink(p.cptr)) }
+func (e *pcapError) Error() string { return e.string }
+func (p *Pcap) Geterror() error    { return &pcapError{C.GoString(C.pcap_geterr(p.cptr))} }
+
+// Next returns the next packet, or nil on timeout, error or end of file.
+func (p *Pcap) Next() (pkt *Packet) {
+	if rv, r := p.NextEx(nil); r > 0 {
+		return rv
+	}
+	return nil
+}
 
 func (h *Pcap) initHdrsData() {
 	h.hdrsize = int(C.Sizeof_pcap_pkthdr())
@@ -147,6 +208,8 @@ func (h *Pcap) initHdrsData() {
 	h.max = 0
 	h.used = 0
 	h.seq = 0
+	h.idle = sync.NewCond(&h.mu)
+	h.resetFilterGen()
 }
 func Create(device string) (handle *Pcap, err error) {
 	var buf *C.char
@@ -256,11 +319,46 @@ func OpenOffline(file string) (handle *Pcap, err error) {
 	} else {
 		handle = h
 		h.initHdrsData()
+		h.offline = true
 	}
 	C.free(unsafe.Pointer(buf))
 	return
 }
 
+// OpenOfflineFile opens a savefile read from f, such as a pipe, starting at
+// its current offset. The handle reads a duplicate of the descriptor, so f
+// can be closed independently.
+func OpenOfflineFile(f *os.File) (handle *Pcap, err error) {
+	buf := (*C.char)(C.calloc(ERRBUF_SIZE, 1))
+	defer C.free(unsafe.Pointer(buf))
+
+	cptr := C.hack_pcap_fopen_offline(C.int(f.Fd()), buf)
+	if cptr == nil {
+		return nil, &pcapError{C.GoString(buf)}
+	}
+	h := &Pcap{cptr: cptr, offline: true}
+	h.initHdrsData()
+	return h, nil
+}
+
+// OpenOfflineReader opens a savefile read from r through a pipe. A goroutine
+// copies r into the pipe until r is exhausted or the handle is closed; an
+// error reading r looks like a truncated savefile to the handle.
+func OpenOfflineReader(r io.Reader) (handle *Pcap, err error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		// Once the handle is closed, writes fail with EPIPE.
+		io.Copy(pw, r)
+		pw.Close()
+	}()
+	handle, err = OpenOfflineFile(pr)
+	pr.Close()
+	return handle, err
+}
+
 func (p *Pcap) FindRawDataLinks() {
 	var dltbuf *C.int
 
@@ -289,10 +387,12 @@ func (p *Pcap) FindRawDataLinks() {
 
 // Pcap closes a handler.
 func (p *Pcap) Close() {
+	p.mu.Lock()
 	if p.cptr != nil {
 		C.pcap_close(p.cptr)
 		p.cptr = nil
 	}
+	p.mu.Unlock()
 	if p.hdrs != nil {
 		C.free(unsafe.Pointer(p.hdrs))
 		p.hdrs = nil
@@ -306,11 +406,38 @@ func (p *Pcap) Close() {
 	p.seq = 0
 }
 
+// BreakLoop makes a NextEx blocked in another goroutine return -2. If no
+// NextEx is blocked, the next one returns -2. It does nothing on a closed
+// handle.
+func (p *Pcap) BreakLoop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cptr == nil {
+		return
+	}
+	p.userBreak = true
+	C.pcap_breakloop(p.cptr)
+}
+
+// cancelBreak withdraws a BreakLoop that no NextEx has reported yet. The
+// pending break of libpcap is then absorbed by the next NextEx.
+func (p *Pcap) cancelBreak() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.userBreak {
+		p.userBreak = false
+		p.filterBreak = true
+	}
+}
+
 func (p *Pcap) IsBufferReleased() bool {
 	return p.hdrs == nil && p.data == nil
 }
 
 func (p *Pcap) NextEx(pktin *Packet) (pkt *Packet, result int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if pktin == nil {
 		pkt = new(Packet)
 	} else {
@@ -322,22 +449,41 @@ func (p *Pcap) NextEx(pktin *Packet) (pkt *Packet, result int32) {
 	}
 	pkt.Data = nil
 
-	if p.max-p.used > 0 {
-		p.getNextPkt(pkt)
-		return pkt, 1
-	}
-	p.used = 0
-	p.max = 0
-	max := int32(C.hack_pcap_next_ex(p.cptr, (*C.char)(p.hdrs), (*C.char)(p.data)))
-	if max > 0 {
-		p.seq++
-		pkt.Seq = p.seq
-		p.max = int(max)
-		p.getNextPkt(pkt)
-
-		return pkt, 1
+	for {
+		if p.max-p.used > 0 {
+			p.getNextPkt(pkt)
+			return pkt, 1
+		}
+		// Let a waiting ReplaceFilter install its filter first.
+		for p.swapping > 0 {
+			p.idle.Wait()
+		}
+		p.used = 0
+		p.max = 0
+		p.bufGen = p.gen
+		p.reading = true
+		p.mu.Unlock()
+		max := int32(C.hack_pcap_next_ex(p.cptr, (*C.char)(p.hdrs), (*C.char)(p.data)))
+		p.mu.Lock()
+		p.reading = false
+		p.idle.Broadcast()
+		switch {
+		case max == C.PCAP_ERROR_BREAK && p.userBreak:
+			p.userBreak = false
+			p.filterBreak = false
+		case max == C.PCAP_ERROR_BREAK && p.filterBreak:
+			// Woken up by ReplaceFilter, read again.
+			p.filterBreak = false
+			continue
+		case max > 0:
+			p.seq++
+			pkt.Seq = p.seq
+			p.max = int(max)
+			p.getNextPkt(pkt)
+			return pkt, 1
+		}
+		return pkt, max
 	}
-	return pkt, max
 }
 
 func (p *Pcap) getNextPkt(pkt *Packet) {
@@ -349,6 +495,8 @@ func (p *Pcap) getNextPkt(pkt *Packet) {
 	pkt.Time = time.Unix(int64(pkthdr.ts.tv_sec), int64(pkthdr.ts.tv_usec)*1000) // pcap provides usec but time.Unix requires nsec
 	pkt.Caplen = uint32(pkthdr.caplen)
 	pkt.Len = uint32(pkthdr.len)
+	pkt.FilterGen = p.bufGen
+	p.account(pkt)
 
 	pkt.LinkType = 1 //LINKTYPE_ETHERNET
 	if p.IsRaw == true {
@@ -380,20 +528,52 @@ func (p *Pcap) Getstats() (stat *Stat, err error) {
 }
 
 func (p *Pcap) SetFilter(expr string) (err error) {
+	_, err = p.ReplaceFilter(expr, SwapMark)
+	return
+}
+
+// ReplaceFilter compiles and installs a new filter while the handle may be
+// read from another goroutine. Packets already buffered by NextEx are either
+// delivered tagged with the old filter generation or discarded, depending on
+// mode. It returns the generation of the new filter.
+//
+// The filter is not changed under a NextEx blocked in the kernel: that
+// read is woken with pcap_breakloop and resumes, without returning -2, once
+// the new filter is installed. On libpcap versions that cannot interrupt a
+// blocked read the swap waits for the next packet or read timeout. Without
+// a blocked reader no break is issued.
+func (p *Pcap) ReplaceFilter(expr string, mode FilterSwap) (uint32, error) {
 	var bpf C.struct_bpf_program
 	cexpr := C.CString(expr)
 	defer C.free(unsafe.Pointer(cexpr))
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.swapping++
+	defer func() {
+		p.swapping--
+		p.idle.Broadcast()
+	}()
+	for p.reading {
+		if !p.filterBreak {
+			p.filterBreak = true
+			C.pcap_breakloop(p.cptr)
+		}
+		p.idle.Wait()
+	}
+
 	if -1 == C.pcap_compile(p.cptr, &bpf, cexpr, 1, 0) {
-		return p.Geterror()
+		return p.gen, p.Geterror()
 	}
+	defer C.pcap_freecode(&bpf)
 
 	if -1 == C.pcap_setfilter(p.cptr, &bpf) {
-		C.pcap_freecode(&bpf)
-		return p.Geterror()
+		return p.gen, p.Geterror()
 	}
-	C.pcap_freecode(&bpf)
-	return nil
+	if mode == SwapDrain {
+		p.discardBuffered()
+	}
+	return p.newFilterGen(expr), nil
 }
 
 func (p *Pcap) SetDirection(direction string) (err error) {
@@ -569,13 +749,90 @@ func (p *Pcap) Inject(data []byte) (err error) {
 }
 
 func (p *Pcap) DumpOpen(ofile *string) (dumper *PcapDumper, err error) {
+	return p.dumpOpen(*ofile, false)
+}
+
+// DumpOpenAppend opens ofile for appending packets. A new file gets a file
+// header; an existing one must match the handle's link type and snaplen.
+func (p *Pcap) DumpOpenAppend(ofile string) (*PcapDumper, error) {
+	return p.dumpOpen(ofile, true)
+}
+
+func (p *Pcap) dumpOpen(ofile string, appendMode bool) (*PcapDumper, error) {
+	cfile := C.CString(ofile)
+	defer C.free(unsafe.Pointer(cfile))
 	d := new(PcapDumper)
-	d.cptr = C.pcap_dump_open(p.cptr, C.CString(*ofile))
+	if appendMode {
+		d.cptr = C.pcap_dump_open_append(p.cptr, cfile)
+	} else {
+		d.cptr = C.pcap_dump_open(p.cptr, cfile)
+	}
 	if nil == d.cptr {
-		return d, errors.New("Cannot open dumpfile")
+		return d, fmt.Errorf("Cannot open dumpfile: %v", p.Geterror())
 	}
-	dumper = d
-	return
+	d.nsec = C.pcap_get_tstamp_precision(p.cptr) == C.PCAP_TSTAMP_PRECISION_NANO
+	return d, nil
+}
+
+var errDumperClosed = errors.New("pcap: dumper closed")
+
+// WritePacket writes pkt with a record header built from its Time, Caplen
+// and Len, so packets from NextEx can be saved directly. Output is
+// buffered; call Flush or Close.
+func (d *PcapDumper) WritePacket(pkt *Packet) error {
+	if d.cptr == nil {
+		return errDumperClosed
+	}
+	caplen := pkt.Caplen
+	if int(caplen) > len(pkt.Data) {
+		caplen = uint32(len(pkt.Data))
+	}
+	frac := pkt.Time.Nanosecond()
+	if !d.nsec {
+		frac /= 1000
+	}
+	var data *C.u_char
+	if caplen > 0 {
+		data = (*C.u_char)(unsafe.Pointer(&pkt.Data[0]))
+	}
+	if 0 != C.hack_pcap_dump_packet(d.cptr, C.long(pkt.Time.Unix()), C.long(frac), C.bpf_u_int32(caplen), C.bpf_u_int32(pkt.Len), data) {
+		return errors.New("pcap: dump write failed")
+	}
+	return nil
+}
+
+// Flush writes buffered packets to the file.
+func (d *PcapDumper) Flush() error {
+	if d.cptr == nil {
+		return errDumperClosed
+	}
+	if -1 == C.pcap_dump_flush(d.cptr) {
+		return errors.New("pcap: dump flush failed")
+	}
+	return nil
+}
+
+// Ftell returns the current size of the file, including buffered packets.
+func (d *PcapDumper) Ftell() (int64, error) {
+	if d.cptr == nil {
+		return 0, errDumperClosed
+	}
+	off := int64(C.pcap_dump_ftell(d.cptr))
+	if off < 0 {
+		return 0, errors.New("pcap: dump ftell failed")
+	}
+	return off, nil
+}
+
+// Close flushes and closes the file. Closing a closed dumper does nothing.
+func (d *PcapDumper) Close() error {
+	if d.cptr == nil {
+		return nil
+	}
+	err := d.Flush()
+	C.pcap_dump_close(d.cptr)
+	d.cptr = nil
+	return err
 }
 
 /*
@@ -625,7 +882,7 @@ func (p *Pcap) PcapDumpFlush(dumper *PcapDumper) error {
 }
 
 func (p *Pcap) PcapDumpClose(dumper *PcapDumper) {
-	C.pcap_dump_close(dumper.cptr)
+	dumper.Close()
 }
 
 type ifreq struct {
@@ -1,9 +1,12 @@
 package pcap
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net"
-	//	"os"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -17,6 +20,52 @@ func TestPcap(t *testing.T) {
 	_ = err
 }
 
+// fixturePackets counts the packets of testPcapFile without libpcap.
+func fixturePackets(t *testing.T) int {
+	f, err := os.Open(testPcapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for r.Next() != nil {
+		n++
+	}
+	if r.Err() != nil || n == 0 {
+		t.Fatalf("fixture has %d packets err:%v", n, r.Err())
+	}
+	return n
+}
+
+func TestPcapOfflineSetFilter(t *testing.T) {
+	want := fixturePackets(t)
+	h, err := OpenOffline(testPcapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.SetFilter(""); err != nil {
+		t.Fatalf("SetFilter failed:%s", err)
+	}
+	n := 0
+	pkt, r := h.NextEx(nil)
+	for ; r > 0; pkt, r = h.NextEx(pkt) {
+		if n++; n == 1 {
+			// Replacing the filter between reads must not end the capture.
+			if err := h.SetFilter(""); err != nil {
+				t.Fatalf("SetFilter failed:%s", err)
+			}
+		}
+	}
+	if n != want || r == -1 {
+		t.Fatalf("read %d of %d packets, result %d", n, want, r)
+	}
+}
+
 type pcapNewHandleFunc func(intf string, filter string, readTo int32) (h *Pcap, err error)
 
 func testPcapHandle(t *testing.T, newHandle pcapNewHandleFunc) {
@@ -36,15 +85,17 @@ func testPcapHandle(t *testing.T, newHandle pcapNewHandleFunc) {
 	go udpSvr(port, numPkts, t)
 	go udpClient(port, numPkts, 1*time.Second, t)
 
-	pktsRecvd := 0
-	for pkt := h.Next(); pkt != nil; pkt = h.Next() {
+	sum, err := h.Capture(context.Background(), Limits{Packets: uint64(numPkts), Duration: 10 * time.Second}, func(pkt *Packet) error {
 		pkt.Decode()
 		t.Logf("Packet:%s dataLen:%d", pkt, len(pkt.Payload))
-		pktsRecvd += 1
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Capture failed err:%s", err)
 	}
 
-	if pktsRecvd != numPkts {
-		t.Fatalf("Capture failed pkts-send:%d, pkts-recvd:%d", numPkts, pktsRecvd)
+	if sum.Packets != uint64(numPkts) || sum.Reason != StopPackets {
+		t.Fatalf("Capture failed pkts-send:%d, pkts-recvd:%d stop:%s", numPkts, sum.Packets, sum.Reason)
 	}
 
 	t.Logf("Successfully captured %d packets", numPkts)
@@ -58,64 +109,155 @@ func TestPcapOpenLive(t *testing.T) {
 	testPcapHandle(t, pcapOpenLive)
 }
 
-/*
-func TestPcapDump(t *testing.T) {
-	port := 54321
-	h, err := pcapOpenLive("lo", fmt.Sprintf("udp dst port %d", port), 2000)
+func TestPcapReplaceFilter(t *testing.T) {
+	port := 54322
+	h, err := pcapOpenLive("lo", fmt.Sprintf("udp dst port %d", port), 500)
 	if h == nil || err != nil {
-		if h != nil {
-			h.Close()
-		}
 		t.Fatalf("Failed to create/init pcap handle err:%s", err)
 	}
+	defer h.Close()
 
-	ofile := "test/pcap_files/dump_test.pcap"
-	d, err := h.DumpOpen(&ofile)
-	if d == nil || err != nil {
-		return
+	gen, err := h.ReplaceFilter(fmt.Sprintf("udp dst port %d", port+1), SwapDrain)
+	if err != nil {
+		t.Fatalf("ReplaceFilter failed err:%s", err)
+	}
+	if gen != 2 || h.FilterGen() != gen {
+		t.Fatalf("Unexpected filter generation %d (handle %d)", gen, h.FilterGen())
 	}
 
-	numPkts := 5
-	go udpSvr(port, numPkts, t)
-	go udpClient(port, numPkts, 1*time.Second, t)
+	numPkts := 3
+	go udpSvr(port+1, numPkts, t)
+	go udpClient(port+1, numPkts, 1*time.Second, t)
 
-	r, err := h.PcapLoop(5, d)
-	if r < 0 || err != nil {
-		return
+	pktsRecvd := 0
+	for i := 0; i < 10 && pktsRecvd < numPkts; i++ {
+		for pkt, r := h.NextEx(nil); r > 0; pkt, r = h.NextEx(nil) {
+			if pkt.FilterGen != gen {
+				t.Fatalf("Packet tagged with generation %d, want %d", pkt.FilterGen, gen)
+			}
+			pktsRecvd++
+		}
 	}
 
-	h.PcapDumpClose(d)
-	h.Close()
+	stats := h.FilterStats()
+	if len(stats) != 3 || stats[2].Packets != uint64(pktsRecvd) || stats[1].Replaced.IsZero() {
+		t.Fatalf("Unexpected filter stats %+v", stats)
+	}
+}
 
-	newh, err := OpenOffline(ofile)
-	if newh == nil {
+func TestPcapDump(t *testing.T) {
+	h, err := OpenOffline(testPcapFile)
+	if h == nil {
 		t.Fatalf("Failed to open pcap:%s", err)
-		return
 	}
-	t.Log("Successfully open pcap")
+	defer h.Close()
+
+	ofile := filepath.Join(t.TempDir(), "dump_test.pcap")
+	d, err := h.DumpOpen(&ofile)
+	if err != nil {
+		t.Fatalf("Failed to open dump file:%s", err)
+	}
+	var want []*Packet
+	for pkt, r := h.NextEx(nil); r > 0; pkt, r = h.NextEx(pkt) {
+		if err := d.WritePacket(pkt); err != nil {
+			t.Fatalf("WritePacket failed:%s", err)
+		}
+		want = append(want, pkt.Clone())
+	}
+	if n, err := d.Ftell(); err != nil || n <= 24 {
+		t.Fatalf("Ftell %d err:%v", n, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close failed:%s", err)
+	}
+	if err := d.WritePacket(want[0]); err == nil {
+		t.Fatal("WritePacket after Close succeeded")
+	}
 
+	d, err = h.DumpOpenAppend(ofile)
+	if err != nil {
+		t.Fatalf("Failed to open dump file for append:%s", err)
+	}
+	for _, pkt := range want {
+		d.WritePacket(pkt)
+	}
+	d.Close()
+
+	f, err := os.Open(ofile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
 	pktsRecvd := 0
-	for pkt := newh.Next(); pkt != nil; pkt = newh.Next() {
-		pkt.Decode()
-		t.Logf("Packet:%s dataLen:%d", pkt, len(pkt.Payload))
-		pktsRecvd += 1
+	for pkt := r.Next(); pkt != nil; pkt = r.Next() {
+		w := want[pktsRecvd%len(want)]
+		if !pkt.Time.Equal(w.Time) || pkt.Len != w.Len || !bytes.Equal(pkt.Data, w.Data) {
+			t.Fatalf("Packet %d differs: %+v, want %+v", pktsRecvd, pkt, w)
+		}
+		pktsRecvd++
+	}
+	if r.Err() != nil || pktsRecvd != 2*len(want) {
+		t.Fatalf("Read %d of %d packets err:%v", pktsRecvd, 2*len(want), r.Err())
 	}
-	newh.Close()
+}
 
-	if pktsRecvd != numPkts {
-		t.Fatalf("Capture failed pkts-send:%d, pkts-recvd:%d", numPkts, pktsRecvd)
+func TestPcapOpenOfflineReader(t *testing.T) {
+	data, err := os.ReadFile(testPcapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func(h *Pcap, filter string) int {
+		defer h.Close()
+		if err := h.SetFilter(filter); err != nil {
+			t.Fatalf("SetFilter failed:%s", err)
+		}
+		n := 0
+		for pkt, r := h.NextEx(nil); r > 0; pkt, r = h.NextEx(pkt) {
+			n++
+		}
+		return n
 	}
 
-	t.Logf("Successfully captured %d packets", numPkts)
+	h, err := OpenOffline(testPcapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := count(h, "")
+	if want := fixturePackets(t); all != want {
+		t.Fatalf("OpenOffline read %d packets, want %d", all, want)
+	}
+	if h, err = OpenOffline(testPcapFile); err != nil {
+		t.Fatal(err)
+	}
+	udp := count(h, "udp")
 
-	err = os.Remove(ofile)
+	if h, err = OpenOfflineReader(bytes.NewReader(data)); err != nil {
+		t.Fatalf("OpenOfflineReader failed:%s", err)
+	}
+	if n := count(h, ""); n != all {
+		t.Errorf("OpenOfflineReader read %d packets, want %d", n, all)
+	}
+	f, err := os.Open(testPcapFile)
 	if err != nil {
-		t.Fatalf("Failed to remote pcap file", err)
+		t.Fatal(err)
+	}
+	if h, err = OpenOfflineFile(f); err != nil {
+		t.Fatalf("OpenOfflineFile failed:%s", err)
+	}
+	f.Close()
+	if n := count(h, "udp"); n != udp {
+		t.Errorf("OpenOfflineFile read %d udp packets, want %d", n, udp)
 	}
 
-	return
+	if h, err = OpenOfflineReader(bytes.NewReader([]byte("not a pcap file"))); err == nil {
+		h.Close()
+		t.Error("OpenOfflineReader accepted garbage")
+	}
 }
-*/
 
 func pcapCreate(intf string, filter string, readTo int32) (h *Pcap, err error) {
 	h, err = Create("lo")
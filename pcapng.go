@@ -0,0 +1,750 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"time"
+)
+
+// pcapng block types.
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+const (
+	NG_BLOCK_SHB        = 0x0A0D0D0A // Section Header
+	NG_BLOCK_IDB        = 0x00000001 // Interface Description
+	NG_BLOCK_PB         = 0x00000002 // Packet (obsolete)
+	NG_BLOCK_SPB        = 0x00000003 // Simple Packet
+	NG_BLOCK_NRB        = 0x00000004 // Name Resolution
+	NG_BLOCK_ISB        = 0x00000005 // Interface Statistics
+	NG_BLOCK_EPB        = 0x00000006 // Enhanced Packet
+	NG_BLOCK_CUSTOM     = 0x00000BAD // Custom, may be copied
+	NG_BLOCK_CUSTOM_NOC = 0x40000BAD // Custom, must not be copied
+
+	NG_BYTE_ORDER_MAGIC = 0x1A2B3C4D
+)
+
+// Direction bits of Packet.Flags (epb_flags).
+const (
+	NG_FLAG_DIR_MASK = 0x3
+	NG_FLAG_INBOUND  = 0x1
+	NG_FLAG_OUTBOUND = 0x2
+)
+
+// pcapng option codes.
+const (
+	ngOptEnd     = 0
+	ngOptComment = 1
+
+	ngShbHardware = 2
+	ngShbOS       = 3
+	ngShbUserAppl = 4
+
+	ngIfName        = 2
+	ngIfDescription = 3
+	ngIfTsresol     = 9
+	ngIfFilter      = 11
+	ngIfOS          = 12
+	ngIfTsoffset    = 14
+
+	ngEpbFlags = 2
+
+	ngIsbStartTime = 2
+	ngIsbEndTime   = 3
+	ngIsbIfRecv    = 4
+	ngIsbIfDrop    = 5
+	ngIsbFilterAcc = 6
+	ngIsbOSDrop    = 7
+	ngIsbUsrDeliv  = 8
+
+	ngNrbEnd  = 0
+	ngNrbIPv4 = 1
+	ngNrbIPv6 = 2
+)
+
+// maxNgBlockSize bounds the blocks NgReader accepts, so a corrupt length
+// cannot make it allocate arbitrary amounts of memory.
+const maxNgBlockSize = 64 << 20
+
+// NgSection is the parsed Section Header Block of a pcapng file.
+type NgSection struct {
+	VersionMajor uint16
+	VersionMinor uint16
+	BigEndian    bool
+	Hardware     string
+	OS           string
+	UserAppl     string
+	Comment      string
+}
+
+// NgInterface is a parsed Interface Description Block. Stats holds the
+// latest Interface Statistics Block for the interface, if any.
+type NgInterface struct {
+	LinkType    int
+	SnapLen     uint32
+	Name        string
+	Description string
+	Filter      string
+	OS          string
+	TsResol     uint8 // if_tsresol, 6 (microseconds) when absent
+	TsOffset    int64 // if_tsoffset in seconds
+	Stats       NgInterfaceStats
+}
+
+// NgInterfaceStats is a parsed Interface Statistics Block.
+type NgInterfaceStats struct {
+	Time      time.Time
+	StartTime time.Time
+	EndTime   time.Time
+	IfRecv    uint64
+	IfDrop    uint64
+	FilterAcc uint64
+	OSDrop    uint64
+	UsrDeliv  uint64
+}
+
+// NgReader parses pcapng files.
+type NgReader struct {
+	buf    io.Reader
+	order  binary.ByteOrder
+	err    error
+	block  []byte
+	offset int64
+
+	Section    NgSection
+	Interfaces []NgInterface
+
+	// Names collects Name Resolution Block entries, address to names.
+	Names map[string][]string
+
+	// OnCustomBlock, if set, is called for every custom block with its
+	// Private Enterprise Number and data. data is only valid during the call.
+	OnCustomBlock func(pen uint32, data []byte, copyable bool)
+}
+
+// NewNgReader reads a pcapng stream from an io.Reader. The first block must
+// be a Section Header Block. Gzip-compressed data is decompressed
+// transparently.
+func NewNgReader(reader io.Reader) (*NgReader, error) {
+	br := bufio.NewReader(reader)
+	gz, err := gunzip(br)
+	if err != nil {
+		return nil, err
+	}
+	r := &NgReader{
+		buf:   br,
+		Names: make(map[string][]string),
+	}
+	if gz != nil {
+		r.buf = gz
+	}
+	typ, body, err := r.readBlock()
+	if err != nil {
+		return nil, err
+	}
+	if typ != NG_BLOCK_SHB {
+		return nil, fmt.Errorf("pcap: not a pcapng file, first block %#x", typ)
+	}
+	if err := r.parseSHB(body); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Next returns the next packet or nil if no more packets can be read.
+func (r *NgReader) Next() *Packet {
+	pkt, _ := r.ReadPacket()
+	return pkt
+}
+
+// Err returns the error that ended the stream, or nil at a clean end of
+// file.
+func (r *NgReader) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
+
+// ReadPacket returns the next packet. Blocks that do not carry packets are
+// parsed into the reader's fields and blocks of unknown type are skipped.
+// It returns io.EOF at the end of the stream.
+func (r *NgReader) ReadPacket() (*Packet, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	for {
+		typ, body, err := r.readBlock()
+		if err != nil {
+			r.err = err
+			return nil, err
+		}
+		var pkt *Packet
+		switch typ {
+		case NG_BLOCK_SHB:
+			err = r.parseSHB(body)
+		case NG_BLOCK_IDB:
+			err = r.parseIDB(body)
+		case NG_BLOCK_EPB:
+			pkt, err = r.parseEPB(body)
+		case NG_BLOCK_SPB:
+			pkt, err = r.parseSPB(body)
+		case NG_BLOCK_PB:
+			pkt, err = r.parsePB(body)
+		case NG_BLOCK_NRB:
+			err = r.parseNRB(body)
+		case NG_BLOCK_ISB:
+			err = r.parseISB(body)
+		case NG_BLOCK_CUSTOM, NG_BLOCK_CUSTOM_NOC:
+			if len(body) >= 4 && r.OnCustomBlock != nil {
+				r.OnCustomBlock(r.order.Uint32(body), body[4:], typ == NG_BLOCK_CUSTOM)
+			}
+		}
+		if err != nil {
+			r.err = err
+			return nil, err
+		}
+		if pkt != nil {
+			return pkt, nil
+		}
+	}
+}
+
+func (r *NgReader) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("pcap: pcapng offset %d: %s", r.offset, fmt.Sprintf(format, args...))
+}
+
+// readBlock reads one block and returns its type and the body between the
+// length fields. The body is only valid until the next call.
+func (r *NgReader) readBlock() (uint32, []byte, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r.buf, hdr[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, r.errorf("truncated block header")
+		}
+		return 0, nil, err
+	}
+	start := r.offset
+	r.offset += 8
+	if binary.LittleEndian.Uint32(hdr[0:4]) == NG_BLOCK_SHB {
+		// The byte order of a section is given by the magic that follows.
+		if _, err := io.ReadFull(r.buf, hdr[8:12]); err != nil {
+			return 0, nil, r.errorf("truncated section header")
+		}
+		r.offset += 4
+		switch binary.LittleEndian.Uint32(hdr[8:12]) {
+		case NG_BYTE_ORDER_MAGIC:
+			r.order = binary.LittleEndian
+		case 0x4D3C2B1A:
+			r.order = binary.BigEndian
+		default:
+			return 0, nil, r.errorf("bad byte-order magic %x", hdr[8:12])
+		}
+	} else if r.order == nil {
+		return 0, nil, r.errorf("block before section header")
+	}
+	typ := r.order.Uint32(hdr[0:4])
+	total := r.order.Uint32(hdr[4:8])
+	if total < 12 || total%4 != 0 || total > maxNgBlockSize {
+		return 0, nil, r.errorf("bad block length %d", total)
+	}
+	n := int(total) - 12
+	if cap(r.block) < n+4 {
+		r.block = make([]byte, n+4)
+	}
+	body := r.block[:n+4]
+	read := 0
+	if typ == NG_BLOCK_SHB {
+		if n < 4 {
+			return 0, nil, r.errorf("bad section header length %d", total)
+		}
+		copy(body, hdr[8:12])
+		read = 4
+	}
+	if _, err := io.ReadFull(r.buf, body[read:]); err != nil {
+		return 0, nil, r.errorf("truncated block of type %#x at offset %d", typ, start)
+	}
+	r.offset += int64(len(body) - read)
+	if trailer := r.order.Uint32(body[n:]); trailer != total {
+		return 0, nil, r.errorf("block length %d does not match trailer %d", total, trailer)
+	}
+	return typ, body[:n], nil
+}
+
+// options calls fn for every option in data until opt_endofopt.
+func (r *NgReader) options(data []byte, fn func(code uint16, value []byte)) {
+	for len(data) >= 4 {
+		code := r.order.Uint16(data[0:2])
+		n := int(r.order.Uint16(data[2:4]))
+		if code == ngOptEnd || 4+n > len(data) {
+			return
+		}
+		fn(code, data[4:4+n])
+		if next := 4 + (n+3)&^3; next < len(data) {
+			data = data[next:]
+		} else {
+			return
+		}
+	}
+}
+
+func (r *NgReader) parseSHB(body []byte) error {
+	if len(body) < 16 {
+		return r.errorf("short section header")
+	}
+	r.Section = NgSection{
+		VersionMajor: r.order.Uint16(body[4:6]),
+		VersionMinor: r.order.Uint16(body[6:8]),
+		BigEndian:    r.order == binary.BigEndian,
+	}
+	if r.Section.VersionMajor != 1 {
+		return r.errorf("unsupported pcapng version %d.%d", r.Section.VersionMajor, r.Section.VersionMinor)
+	}
+	r.options(body[16:], func(code uint16, v []byte) {
+		switch code {
+		case ngOptComment:
+			r.Section.Comment = string(v)
+		case ngShbHardware:
+			r.Section.Hardware = string(v)
+		case ngShbOS:
+			r.Section.OS = string(v)
+		case ngShbUserAppl:
+			r.Section.UserAppl = string(v)
+		}
+	})
+	// Interface IDs are scoped to a section.
+	r.Interfaces = nil
+	return nil
+}
+
+func (r *NgReader) parseIDB(body []byte) error {
+	if len(body) < 8 {
+		return r.errorf("short interface description")
+	}
+	ifc := NgInterface{
+		LinkType: int(r.order.Uint16(body[0:2])),
+		SnapLen:  r.order.Uint32(body[4:8]),
+		TsResol:  6,
+	}
+	r.options(body[8:], func(code uint16, v []byte) {
+		switch code {
+		case ngIfName:
+			ifc.Name = string(v)
+		case ngIfDescription:
+			ifc.Description = string(v)
+		case ngIfFilter:
+			// The first byte tells the filter type, 0 is a libpcap string.
+			if len(v) > 1 && v[0] == 0 {
+				ifc.Filter = string(v[1:])
+			}
+		case ngIfOS:
+			ifc.OS = string(v)
+		case ngIfTsresol:
+			if len(v) >= 1 {
+				ifc.TsResol = v[0]
+			}
+		case ngIfTsoffset:
+			if len(v) >= 8 {
+				ifc.TsOffset = int64(r.order.Uint64(v))
+			}
+		}
+	})
+	r.Interfaces = append(r.Interfaces, ifc)
+	return nil
+}
+
+func (r *NgReader) iface(id uint32) (*NgInterface, error) {
+	if int(id) >= len(r.Interfaces) {
+		return nil, r.errorf("packet for undeclared interface %d", id)
+	}
+	return &r.Interfaces[id], nil
+}
+
+// ngTime converts a pcapng timestamp in units of ifc.TsResol to a time.
+func ngTime(ifc *NgInterface, ts uint64) time.Time {
+	var sec, nsec uint64
+	if ifc.TsResol&0x80 == 0 {
+		div := uint64(1)
+		for i := uint8(0); i < ifc.TsResol && i < 19; i++ {
+			div *= 10
+		}
+		sec, nsec = ts/div, ts%div
+		switch {
+		case div < 1e9:
+			nsec *= 1e9 / div
+		case div > 1e9:
+			nsec /= div / 1e9
+		}
+	} else {
+		shift := uint(ifc.TsResol & 0x7f)
+		if shift >= 64 {
+			shift = 63
+		}
+		sec = ts >> shift
+		hi, lo := bits.Mul64(ts&(1<<shift-1), 1e9)
+		nsec = lo >> shift
+		if shift > 0 {
+			nsec |= hi << (64 - shift)
+		}
+	}
+	return time.Unix(int64(sec)+ifc.TsOffset, int64(nsec))
+}
+
+func (r *NgReader) newPacket(id uint32, ifc *NgInterface, ts uint64, capLen, origLen uint32, data []byte) (*Packet, error) {
+	if int(capLen) > len(data) {
+		return nil, r.errorf("captured length %d exceeds block", capLen)
+	}
+	pkt := &Packet{
+		Time:        ngTime(ifc, ts),
+		Caplen:      capLen,
+		Len:         origLen,
+		LinkType:    ifc.LinkType,
+		InterfaceID: id,
+		Data:        make([]byte, capLen),
+	}
+	copy(pkt.Data, data)
+	return pkt, nil
+}
+
+func (r *NgReader) parseEPB(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, r.errorf("short enhanced packet block")
+	}
+	id := r.order.Uint32(body[0:4])
+	ifc, err := r.iface(id)
+	if err != nil {
+		return nil, err
+	}
+	ts := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+	pkt, err := r.newPacket(id, ifc, ts, r.order.Uint32(body[12:16]), r.order.Uint32(body[16:20]), body[20:])
+	if err != nil {
+		return nil, err
+	}
+	if opts := 20 + (int(pkt.Caplen)+3)&^3; opts < len(body) {
+		r.options(body[opts:], func(code uint16, v []byte) {
+			switch code {
+			case ngOptComment:
+				pkt.Comment = string(v)
+			case ngEpbFlags:
+				if len(v) >= 4 {
+					pkt.Flags = r.order.Uint32(v)
+				}
+			}
+		})
+	}
+	return pkt, nil
+}
+
+func (r *NgReader) parseSPB(body []byte) (*Packet, error) {
+	if len(body) < 4 {
+		return nil, r.errorf("short simple packet block")
+	}
+	ifc, err := r.iface(0)
+	if err != nil {
+		return nil, err
+	}
+	origLen := r.order.Uint32(body[0:4])
+	capLen := origLen
+	if ifc.SnapLen > 0 && capLen > ifc.SnapLen {
+		capLen = ifc.SnapLen
+	}
+	if int(capLen) > len(body)-4 {
+		capLen = uint32(len(body) - 4)
+	}
+	// Simple packets carry no timestamp.
+	pkt, err := r.newPacket(0, ifc, 0, capLen, origLen, body[4:])
+	if err != nil {
+		return nil, err
+	}
+	pkt.Time = time.Time{}
+	return pkt, nil
+}
+
+func (r *NgReader) parsePB(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, r.errorf("short packet block")
+	}
+	id := uint32(r.order.Uint16(body[0:2]))
+	ifc, err := r.iface(id)
+	if err != nil {
+		return nil, err
+	}
+	ts := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+	return r.newPacket(id, ifc, ts, r.order.Uint32(body[12:16]), r.order.Uint32(body[16:20]), body[20:])
+}
+
+func (r *NgReader) parseNRB(body []byte) error {
+	for len(body) >= 4 {
+		typ := r.order.Uint16(body[0:2])
+		n := int(r.order.Uint16(body[2:4]))
+		if typ == ngNrbEnd || 4+n > len(body) {
+			return nil
+		}
+		v := body[4 : 4+n]
+		var addr int
+		switch typ {
+		case ngNrbIPv4:
+			addr = 4
+		case ngNrbIPv6:
+			addr = 16
+		}
+		if addr > 0 && len(v) > addr {
+			ip := net.IP(append([]byte(nil), v[:addr]...)).String()
+			for _, name := range splitNul(v[addr:]) {
+				r.Names[ip] = append(r.Names[ip], name)
+			}
+		}
+		if next := 4 + (n+3)&^3; next < len(body) {
+			body = body[next:]
+		} else {
+			return nil
+		}
+	}
+	return nil
+}
+
+func splitNul(b []byte) (s []string) {
+	start := 0
+	for i, c := range b {
+		if c == 0 {
+			if i > start {
+				s = append(s, string(b[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	if start < len(b) {
+		s = append(s, string(b[start:]))
+	}
+	return
+}
+
+func (r *NgReader) parseISB(body []byte) error {
+	if len(body) < 12 {
+		return r.errorf("short interface statistics block")
+	}
+	ifc, err := r.iface(r.order.Uint32(body[0:4]))
+	if err != nil {
+		return err
+	}
+	ts := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+	st := NgInterfaceStats{Time: ngTime(ifc, ts)}
+	r.options(body[12:], func(code uint16, v []byte) {
+		if len(v) < 8 {
+			return
+		}
+		u := r.order.Uint64(v)
+		switch code {
+		case ngIsbStartTime, ngIsbEndTime:
+			// Timestamps are stored high word first.
+			t := ngTime(ifc, uint64(r.order.Uint32(v[0:4]))<<32|uint64(r.order.Uint32(v[4:8])))
+			if code == ngIsbStartTime {
+				st.StartTime = t
+			} else {
+				st.EndTime = t
+			}
+		case ngIsbIfRecv:
+			st.IfRecv = u
+		case ngIsbIfDrop:
+			st.IfDrop = u
+		case ngIsbFilterAcc:
+			st.FilterAcc = u
+		case ngIsbOSDrop:
+			st.OSDrop = u
+		case ngIsbUsrDeliv:
+			st.UsrDeliv = u
+		}
+	})
+	ifc.Stats = st
+	return nil
+}
+
+// NgWriter writes a pcapng file with a single section.
+type NgWriter struct {
+	writer     io.Writer
+	order      binary.ByteOrder
+	interfaces []NgInterface
+	buf        []byte
+}
+
+// NewNgWriter creates an NgWriter that stores output in an io.Writer. The
+// Section Header Block, with the hardware, OS, application and comment of
+// section, and an Interface Description Block for each of interfaces are
+// written immediately. A zero TsResol in an interface means microseconds.
+func NewNgWriter(writer io.Writer, section NgSection, interfaces []NgInterface) (*NgWriter, error) {
+	w := &NgWriter{writer: writer, order: binary.LittleEndian}
+	if section.BigEndian {
+		w.order = binary.BigEndian
+	}
+	b := w.begin(NG_BLOCK_SHB)
+	b = w.appendUint32(b, NG_BYTE_ORDER_MAGIC)
+	b = w.appendUint16(b, 1)
+	b = w.appendUint16(b, 0)
+	// Section length is not specified.
+	b = append(b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	b = w.appendStringOption(b, ngShbHardware, section.Hardware)
+	b = w.appendStringOption(b, ngShbOS, section.OS)
+	b = w.appendStringOption(b, ngShbUserAppl, section.UserAppl)
+	b = w.appendStringOption(b, ngOptComment, section.Comment)
+	if err := w.end(b, true); err != nil {
+		return nil, err
+	}
+	for _, ifc := range interfaces {
+		if _, err := w.AddInterface(ifc); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// AddInterface writes an Interface Description Block and returns the
+// interface ID to set in Packet.InterfaceID.
+func (w *NgWriter) AddInterface(ifc NgInterface) (uint32, error) {
+	if ifc.TsResol == 0 {
+		ifc.TsResol = 6
+	}
+	b := w.begin(NG_BLOCK_IDB)
+	b = w.appendUint16(b, uint16(ifc.LinkType))
+	b = w.appendUint16(b, 0)
+	b = w.appendUint32(b, ifc.SnapLen)
+	b = w.appendStringOption(b, ngIfName, ifc.Name)
+	b = w.appendStringOption(b, ngIfDescription, ifc.Description)
+	if ifc.TsResol != 6 {
+		b = w.appendOption(b, ngIfTsresol, []byte{ifc.TsResol})
+	}
+	if ifc.Filter != "" {
+		b = w.appendOption(b, ngIfFilter, append([]byte{0}, ifc.Filter...))
+	}
+	b = w.appendStringOption(b, ngIfOS, ifc.OS)
+	if ifc.TsOffset != 0 {
+		var v [8]byte
+		w.order.PutUint64(v[:], uint64(ifc.TsOffset))
+		b = w.appendOption(b, ngIfTsoffset, v[:])
+	}
+	if err := w.end(b, true); err != nil {
+		return 0, err
+	}
+	w.interfaces = append(w.interfaces, ifc)
+	return uint32(len(w.interfaces) - 1), nil
+}
+
+// Write writes pkt as an Enhanced Packet Block on interface
+// pkt.InterfaceID, with pkt.Flags and pkt.Comment as options. Data beyond
+// the interface snaplen is not written.
+func (w *NgWriter) Write(pkt *Packet) error {
+	if int(pkt.InterfaceID) >= len(w.interfaces) {
+		return fmt.Errorf("pcap: pcapng interface %d not declared", pkt.InterfaceID)
+	}
+	ifc := &w.interfaces[pkt.InterfaceID]
+	data := pkt.Data
+	if ifc.SnapLen > 0 && uint32(len(data)) > ifc.SnapLen {
+		data = data[:ifc.SnapLen]
+	}
+	origLen := pkt.Len
+	if origLen < uint32(len(data)) {
+		origLen = uint32(len(data))
+	}
+	ts := ngTimestamp(ifc, pkt.Time)
+	b := w.begin(NG_BLOCK_EPB)
+	b = w.appendUint32(b, pkt.InterfaceID)
+	b = w.appendUint32(b, uint32(ts>>32))
+	b = w.appendUint32(b, uint32(ts))
+	b = w.appendUint32(b, uint32(len(data)))
+	b = w.appendUint32(b, origLen)
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	opts := false
+	if pkt.Flags != 0 {
+		var v [4]byte
+		w.order.PutUint32(v[:], pkt.Flags)
+		b = w.appendOption(b, ngEpbFlags, v[:])
+		opts = true
+	}
+	if pkt.Comment != "" {
+		b = w.appendStringOption(b, ngOptComment, pkt.Comment)
+		opts = true
+	}
+	return w.end(b, opts)
+}
+
+// ngTimestamp is the inverse of ngTime.
+func ngTimestamp(ifc *NgInterface, t time.Time) uint64 {
+	sec := uint64(t.Unix() - ifc.TsOffset)
+	nsec := uint64(t.Nanosecond())
+	if ifc.TsResol&0x80 == 0 {
+		mul := uint64(1)
+		for i := uint8(0); i < ifc.TsResol && i < 19; i++ {
+			mul *= 10
+		}
+		switch {
+		case mul < 1e9:
+			nsec /= 1e9 / mul
+		case mul > 1e9:
+			nsec *= mul / 1e9
+		}
+		return sec*mul + nsec
+	}
+	shift := uint(ifc.TsResol & 0x7f)
+	if shift >= 64 {
+		shift = 63
+	}
+	hi, lo := bits.Mul64(nsec, 1<<shift)
+	frac, _ := bits.Div64(hi, lo, 1e9)
+	return sec<<shift | frac
+}
+
+// begin starts a block in w.buf, leaving room for the length.
+func (w *NgWriter) begin(typ uint32) []byte {
+	b := w.appendUint32(w.buf[:0], typ)
+	return append(b, 0, 0, 0, 0)
+}
+
+// end terminates the options if any were written, fills in the lengths
+// and writes the block.
+func (w *NgWriter) end(b []byte, opts bool) error {
+	if opts {
+		b = w.appendUint32(b, 0) // opt_endofopt
+	}
+	total := uint32(len(b) + 4)
+	w.order.PutUint32(b[4:8], total)
+	b = w.appendUint32(b, total)
+	w.buf = b
+	_, err := w.writer.Write(b)
+	return err
+}
+
+func (w *NgWriter) appendUint16(b []byte, v uint16) []byte {
+	var u [2]byte
+	w.order.PutUint16(u[:], v)
+	return append(b, u[:]...)
+}
+
+func (w *NgWriter) appendUint32(b []byte, v uint32) []byte {
+	var u [4]byte
+	w.order.PutUint32(u[:], v)
+	return append(b, u[:]...)
+}
+
+func (w *NgWriter) appendOption(b []byte, code uint16, v []byte) []byte {
+	b = w.appendUint16(b, code)
+	b = w.appendUint16(b, uint16(len(v)))
+	b = append(b, v...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func (w *NgWriter) appendStringOption(b []byte, code uint16, v string) []byte {
+	if v == "" {
+		return b
+	}
+	if len(v) > 0xffff {
+		v = v[:0xffff]
+	}
+	return w.appendOption(b, code, []byte(v))
+}
@@ -0,0 +1,208 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// ngBuilder assembles pcapng blocks for tests.
+type ngBuilder struct {
+	order binary.ByteOrder
+	bytes.Buffer
+}
+
+func (b *ngBuilder) block(typ uint32, body []byte) {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	var u [4]byte
+	b.order.PutUint32(u[:], typ)
+	b.Write(u[:])
+	b.order.PutUint32(u[:], uint32(len(body)+12))
+	b.Write(u[:])
+	b.Write(body)
+	b.Write(u[:])
+}
+
+func (b *ngBuilder) option(code uint16, v []byte) []byte {
+	o := make([]byte, 4, 4+len(v)+3)
+	b.order.PutUint16(o[0:], code)
+	b.order.PutUint16(o[2:], uint16(len(v)))
+	o = append(o, v...)
+	for len(o)%4 != 0 {
+		o = append(o, 0)
+	}
+	return o
+}
+
+func (b *ngBuilder) u16(v uint16) []byte { o := make([]byte, 2); b.order.PutUint16(o, v); return o }
+func (b *ngBuilder) u32(v uint32) []byte { o := make([]byte, 4); b.order.PutUint32(o, v); return o }
+
+func (b *ngBuilder) epb(id uint32, ts uint64, data []byte) {
+	var body []byte
+	body = append(body, b.u32(id)...)
+	body = append(body, b.u32(uint32(ts>>32))...)
+	body = append(body, b.u32(uint32(ts))...)
+	body = append(body, b.u32(uint32(len(data)))...)
+	body = append(body, b.u32(uint32(len(data)))...)
+	body = append(body, data...)
+	b.block(NG_BLOCK_EPB, body)
+}
+
+func buildNgFile(order binary.ByteOrder) []byte {
+	b := &ngBuilder{order: order}
+	var shb []byte
+	shb = append(shb, b.u32(NG_BYTE_ORDER_MAGIC)...)
+	shb = append(shb, b.u16(1)...)
+	shb = append(shb, b.u16(0)...)
+	shb = append(shb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	shb = append(shb, b.option(ngShbUserAppl, []byte("test"))...)
+	b.block(NG_BLOCK_SHB, shb)
+
+	// Interface 0: Ethernet, microseconds.
+	idb := append(b.u16(LINKTYPE_ETHERNET), 0, 0)
+	idb = append(idb, b.u32(65535)...)
+	idb = append(idb, b.option(ngIfName, []byte("eth0"))...)
+	b.block(NG_BLOCK_IDB, idb)
+	// Interface 1: raw IP, nanoseconds.
+	idb = append(b.u16(LINKTYPE_RAW), 0, 0)
+	idb = append(idb, b.u32(65535)...)
+	idb = append(idb, b.option(ngIfTsresol, []byte{9})...)
+	b.block(NG_BLOCK_IDB, idb)
+
+	// An unknown block and a custom block to skip.
+	b.block(0x12345678, []byte{1, 2, 3})
+	b.block(NG_BLOCK_CUSTOM, append(b.u32(32473), 'x'))
+
+	nrb := append(b.u16(ngNrbIPv4), b.u16(4+9)...)
+	nrb = append(nrb, 10, 0, 0, 1)
+	nrb = append(nrb, []byte("host.lan\x00")...)
+	nrb = append(nrb, 0, 0, 0)
+	nrb = append(nrb, 0, 0, 0, 0)
+	b.block(NG_BLOCK_NRB, nrb)
+
+	eth := udpPacket(time.Time{}, 1, 2, 1, 2, []byte("a")).Data
+	b.epb(0, 1500000000123456, eth)
+	b.epb(1, 1500000000123456789, eth[14:])
+
+	isb := b.u32(0)
+	isb = append(isb, b.u32(0)...)
+	isb = append(isb, b.u32(0)...)
+	isb = append(isb, b.option(ngIsbIfDrop, make([]byte, 8))...)
+	b.block(NG_BLOCK_ISB, isb)
+	return b.Bytes()
+}
+
+func TestNgReader(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		r, err := NewNgReader(bytes.NewReader(buildNgFile(order)))
+		if err != nil {
+			t.Fatalf("%s: %v", order, err)
+		}
+		custom := 0
+		r.OnCustomBlock = func(pen uint32, data []byte, copyable bool) {
+			if pen != 32473 || string(data[:1]) != "x" || !copyable {
+				t.Errorf("%s: custom block %d %q", order, pen, data)
+			}
+			custom++
+		}
+		var pkts []*Packet
+		for pkt := r.Next(); pkt != nil; pkt = r.Next() {
+			pkts = append(pkts, pkt)
+		}
+		if err := r.Err(); err != nil {
+			t.Fatalf("%s: %v", order, err)
+		}
+		if len(pkts) != 2 || custom != 1 {
+			t.Fatalf("%s: %d packets, %d custom blocks", order, len(pkts), custom)
+		}
+		if pkts[0].LinkType != LINKTYPE_ETHERNET || pkts[0].InterfaceID != 0 ||
+			!pkts[0].Time.Equal(time.Unix(1500000000, 123456000)) {
+			t.Errorf("%s: packet 0 %d %d %s", order, pkts[0].LinkType, pkts[0].InterfaceID, pkts[0].Time)
+		}
+		if pkts[1].LinkType != LINKTYPE_RAW || pkts[1].InterfaceID != 1 ||
+			!pkts[1].Time.Equal(time.Unix(1500000000, 123456789)) {
+			t.Errorf("%s: packet 1 %d %d %s", order, pkts[1].LinkType, pkts[1].InterfaceID, pkts[1].Time)
+		}
+		if r.Interfaces[0].Name != "eth0" || r.Section.UserAppl != "test" {
+			t.Errorf("%s: interface %+v section %+v", order, r.Interfaces[0], r.Section)
+		}
+		if names := r.Names["10.0.0.1"]; len(names) != 1 || names[0] != "host.lan" {
+			t.Errorf("%s: names %v", order, r.Names)
+		}
+	}
+}
+
+func TestNgTimeBinaryResolution(t *testing.T) {
+	ifc := &NgInterface{TsResol: 0x80 | 10}
+	if got := ngTime(ifc, 5<<10|512); !got.Equal(time.Unix(5, 500000000)) {
+		t.Fatalf("2^-10 resolution: %s", got)
+	}
+}
+
+func TestNgReaderTruncated(t *testing.T) {
+	data := buildNgFile(binary.LittleEndian)
+	r, err := NewNgReader(bytes.NewReader(data[:len(data)-10]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pkt := r.Next(); pkt != nil; pkt = r.Next() {
+	}
+	if r.Err() == nil {
+		t.Fatal("truncated file read without error")
+	}
+}
+
+func TestNgWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewNgWriter(&buf, NgSection{Hardware: "x86_64", OS: "Linux", UserAppl: "pcap test"}, []NgInterface{
+		{LinkType: LINKTYPE_ETHERNET, SnapLen: 65535, Name: "eth0", Filter: "udp"},
+		{LinkType: LINKTYPE_RAW, SnapLen: 20, Name: "tun0", TsResol: 9},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1500000000, 123456789)
+	in := udpPacket(ts, 1, 2, 1, 2, []byte("hello"))
+	in.Flags = NG_FLAG_INBOUND
+	in.Comment = "first"
+	if err := w.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	raw := udpPacket(ts, 2, 1, 2, 1, []byte("world"))
+	raw.Data = raw.Data[14:]
+	raw.Len -= 14
+	raw.InterfaceID = 1
+	raw.Flags = NG_FLAG_OUTBOUND
+	if err := w.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&Packet{InterfaceID: 2}); err == nil {
+		t.Fatal("wrote packet on undeclared interface")
+	}
+
+	r, err := NewNgReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p0, p1 := r.Next(), r.Next()
+	if r.Next() != nil || r.Err() != nil || p1 == nil {
+		t.Fatalf("unexpected end of stream: %v", r.Err())
+	}
+	if r.Section.Hardware != "x86_64" || r.Section.OS != "Linux" || r.Section.UserAppl != "pcap test" {
+		t.Errorf("section %+v", r.Section)
+	}
+	if ifc := r.Interfaces[0]; ifc.Name != "eth0" || ifc.Filter != "udp" || ifc.TsResol != 6 {
+		t.Errorf("interface 0 %+v", ifc)
+	}
+	if !bytes.Equal(p0.Data, in.Data) || p0.Flags != NG_FLAG_INBOUND || p0.Comment != "first" ||
+		!p0.Time.Equal(ts.Truncate(time.Microsecond)) {
+		t.Errorf("packet 0 %+v", p0)
+	}
+	if p1.InterfaceID != 1 || p1.LinkType != LINKTYPE_RAW || p1.Caplen != 20 || p1.Len != raw.Len ||
+		p1.Flags&NG_FLAG_DIR_MASK != NG_FLAG_OUTBOUND || !p1.Time.Equal(ts) {
+		t.Errorf("packet 1 %+v", p1)
+	}
+}
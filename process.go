@@ -0,0 +1,156 @@
+package pcap
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// ProcessOptions controls ProcessReader.
+type ProcessOptions struct {
+	Workers int // goroutines calling Decode and fn, defaults to runtime.NumCPU()
+	Queue   int // packets in flight before reading blocks, defaults to 4*Workers
+
+	// Collect, if set, receives every packet with the result fn returned
+	// for it, one at a time. With Ordered it sees the packets in the order
+	// they were read, otherwise in the order the workers finish them.
+	Collect func(pkt *Packet, result interface{})
+	Ordered bool
+}
+
+type processItem struct {
+	seq    uint64
+	pkt    *Packet
+	result interface{}
+	err    error
+}
+
+// ProcessFile decodes the packets of the pcap file at path on workers
+// goroutines and calls fn for each. fn is called concurrently and in no
+// particular order. The first error fn returns stops the processing and
+// is returned; ErrStopCapture stops it without an error.
+func ProcessFile(path string, workers int, fn func(*Packet) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := NewReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	return ProcessReader(r, ProcessOptions{Workers: workers}, func(pkt *Packet) (interface{}, error) {
+		return nil, fn(pkt)
+	})
+}
+
+// ProcessReader reads src on one goroutine, decodes the packets and calls
+// fn for them on opts.Workers goroutines, and passes the results to
+// opts.Collect. At most opts.Queue packets are in flight, so a slow fn or
+// Collect holds back reading. The first error fn returns stops the
+// processing and is returned, as is the error of a src with an Err method
+// such as Reader; ErrStopCapture stops it without an error.
+//
+// The packets of src must stay valid after the next call to Next, as those
+// of Reader do; packets from Pcap must be cloned first.
+func ProcessReader(src PacketSource, opts ProcessOptions, fn func(*Packet) (interface{}, error)) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	queue := opts.Queue
+	if queue <= 0 {
+		queue = 4 * workers
+	}
+	tokens := make(chan struct{}, queue)
+	jobs := make(chan processItem, workers)
+	results := make(chan processItem, workers)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(jobs)
+		for seq := uint64(0); ; seq++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-stop:
+				return
+			}
+			pkt := src.Next()
+			if pkt == nil {
+				return
+			}
+			select {
+			case jobs <- processItem{seq: seq, pkt: pkt}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range jobs {
+				select {
+				case <-stop:
+					// Drain without processing.
+				default:
+					it.pkt.Decode()
+					it.result, it.err = fn(it.pkt)
+				}
+				results <- it
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var err error
+	stopped := false
+	deliver := func(it processItem) {
+		<-tokens
+		if stopped {
+			return
+		}
+		if it.err != nil {
+			if it.err != ErrStopCapture {
+				err = it.err
+			}
+			stopped = true
+			close(stop)
+			return
+		}
+		if opts.Collect != nil {
+			opts.Collect(it.pkt, it.result)
+		}
+	}
+	pending := make(map[uint64]processItem)
+	var next uint64
+	for it := range results {
+		if !opts.Ordered {
+			deliver(it)
+			continue
+		}
+		pending[it.seq] = it
+		for {
+			it, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			deliver(it)
+		}
+	}
+	if !stopped {
+		if e, ok := src.(interface{ Err() error }); ok {
+			err = e.Err()
+		}
+	}
+	return err
+}
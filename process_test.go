@@ -0,0 +1,78 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProcess(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, testHeader())
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < 1000; i++ {
+		w.Write(udpPacket(start.Add(time.Duration(i)*time.Millisecond), 1, 2, uint16(i), 53, nil))
+	}
+	data := buf.Bytes()
+	path := filepath.Join(t.TempDir(), "test.pcap")
+	os.WriteFile(path, data, 0644)
+
+	var n int64
+	err := ProcessFile(path, 4, func(pkt *Packet) error {
+		if pkt.Headers_cnt == 0 {
+			return errors.New("packet not decoded")
+		}
+		atomic.AddInt64(&n, 1)
+		return nil
+	})
+	if err != nil || n != 1000 {
+		t.Fatalf("ProcessFile: %d packets, err %v", n, err)
+	}
+
+	port := func(pkt *Packet) (interface{}, error) {
+		key, _ := FlowKeyOf(pkt)
+		if key.PortA%7 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return int(key.PortA), nil
+	}
+	r, _ := NewReader(bytes.NewReader(data))
+	next := 0
+	err = ProcessReader(r, ProcessOptions{Workers: 4, Queue: 8, Ordered: true, Collect: func(pkt *Packet, result interface{}) {
+		if result.(int) != next {
+			t.Fatalf("got port %d, want %d", result, next)
+		}
+		next++
+	}}, port)
+	if err != nil || next != 1000 {
+		t.Fatalf("ordered: %d packets, err %v", next, err)
+	}
+
+	errBad := errors.New("bad packet")
+	for _, tc := range []struct {
+		fail error
+		want error
+	}{{errBad, errBad}, {ErrStopCapture, nil}} {
+		r, _ = NewReader(bytes.NewReader(data))
+		var collected int64
+		err = ProcessReader(r, ProcessOptions{Workers: 4, Collect: func(*Packet, interface{}) { collected++ }}, func(pkt *Packet) (interface{}, error) {
+			if p, _ := port(pkt); p.(int) == 500 {
+				return nil, tc.fail
+			}
+			return nil, nil
+		})
+		if err != tc.want || collected >= 1000 {
+			t.Fatalf("stop with %v: err %v after %d packets", tc.fail, err, collected)
+		}
+	}
+
+	r, _ = NewReader(bytes.NewReader(data[:len(data)-5]))
+	if err = ProcessReader(r, ProcessOptions{}, port); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated file: %v", err)
+	}
+}
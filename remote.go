@@ -0,0 +1,593 @@
+package pcap
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The remote capture protocol runs over TCP, optionally with TLS. The
+// client sends remoteMagic and an open frame with a JSON RemoteRequest. The
+// server answers with an error frame, or with a ready frame followed by
+// packet frames and periodic stats frames until the capture ends with an
+// EOF or error frame. Meanwhile the client may send filter frames, each
+// answered by a filter result frame, and a close frame.
+//
+// A frame is a type byte, a big-endian uint32 payload length and the
+// payload.
+const remoteMagic = "PCAPRMT1"
+
+const (
+	remoteOpen         byte = iota + 1 // JSON RemoteRequest
+	remoteReady                        // datalink uint32
+	remotePacket                       // see appendRemotePacket
+	remoteStats                        // received, dropped, ifdropped uint32
+	remoteFilter                       // filter expression
+	remoteFilterResult                 // error message, empty on success
+	remoteError                        // error message
+	remoteEOF                          // no payload
+	remoteClose                        // no payload
+)
+
+const (
+	maxRemoteFrame    = 1 << 20
+	remotePacketHdr   = 24
+	remoteQueue       = 1024
+	remoteHandshake   = 10 * time.Second
+	remoteReadTimeout = 100 // ms, for handles opened by a RemoteServer
+)
+
+// RemoteRequest asks a RemoteServer to open a capture.
+type RemoteRequest struct {
+	Token   string `json:"token"`
+	Device  string `json:"device"`
+	Filter  string `json:"filter,omitempty"`
+	SnapLen int32  `json:"snaplen"`
+	Promisc bool   `json:"promisc,omitempty"`
+}
+
+// RemoteServer serves captures to RemoteClients.
+type RemoteServer struct {
+	// Token is the pre-shared token clients must present. It is required.
+	Token string
+
+	// TLSConfig, if set, makes Serve accept TLS connections only.
+	TLSConfig *tls.Config
+
+	// Interfaces lists the devices clients may capture on.
+	Interfaces []string
+
+	MaxSnapLen    int32         // largest snaplen, 65535 if zero
+	StatsInterval time.Duration // how often Getstats is sent, one second if zero
+
+	// Open opens the handle for a checked request. It defaults to
+	// OpenLive with a 100ms read timeout.
+	Open func(req RemoteRequest) (Handle, error)
+}
+
+// Serve accepts connections on l and serves each on its own goroutine. It
+// returns the error that stopped Accept, such as when l is closed;
+// captures already running are not stopped.
+func (s *RemoteServer) Serve(l net.Listener) error {
+	if s.Token == "" {
+		return errors.New("pcap: RemoteServer needs a Token")
+	}
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves one client on conn and closes it.
+func (s *RemoteServer) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+	var wmu sync.Mutex
+	send := func(typ byte, payload []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		if err := writeFrame(bw, typ, payload); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+	fail := func(err error) {
+		send(remoteError, []byte(err.Error()))
+	}
+
+	conn.SetDeadline(time.Now().Add(remoteHandshake))
+	req, err := s.handshake(br)
+	if err != nil {
+		fail(err)
+		return
+	}
+	open := s.Open
+	if open == nil {
+		open = func(req RemoteRequest) (Handle, error) {
+			return OpenLive(req.Device, req.SnapLen, req.Promisc, remoteReadTimeout)
+		}
+	}
+	h, err := open(req)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer h.Close()
+	if req.Filter != "" {
+		if err := h.SetFilter(req.Filter); err != nil {
+			fail(err)
+			return
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[:], uint32(packetLinkType(h)))
+	if send(remoteReady, b[:4]) != nil {
+		return
+	}
+
+	// The handle must outlive the control goroutine, which may call
+	// BreakLoop.
+	var stop int32
+	done := make(chan struct{})
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		for {
+			typ, payload, err := readFrame(br)
+			if err != nil || typ == remoteClose {
+				atomic.StoreInt32(&stop, 1)
+				h.BreakLoop()
+				return
+			}
+			if typ == remoteFilter {
+				var res string
+				if err := h.SetFilter(string(payload)); err != nil {
+					res = err.Error()
+				}
+				send(remoteFilterResult, []byte(res))
+			}
+		}
+	}()
+
+	interval := s.StatsInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	sendStats := func() error {
+		st, err := h.Getstats()
+		if err != nil {
+			return nil
+		}
+		binary.BigEndian.PutUint32(b[0:], st.PacketsReceived)
+		binary.BigEndian.PutUint32(b[4:], st.PacketsDropped)
+		binary.BigEndian.PutUint32(b[8:], st.PacketsIfDropped)
+		return send(remoteStats, b[:])
+	}
+	var pkt *Packet
+	var buf []byte
+	lastStats := time.Now()
+	for atomic.LoadInt32(&stop) == 0 {
+		var r int32
+		pkt, r = h.NextEx(pkt)
+		switch {
+		case r > 0:
+			buf = appendRemotePacket(buf[:0], pkt)
+			err = send(remotePacket, buf)
+		case r == 0:
+		case r == -1:
+			if err := h.Geterror(); err != nil {
+				fail(err)
+			}
+			return
+		default:
+			if atomic.LoadInt32(&stop) == 0 {
+				if sendStats() == nil {
+					send(remoteEOF, nil)
+				}
+			}
+			return
+		}
+		if err == nil && time.Since(lastStats) >= interval {
+			lastStats = time.Now()
+			err = sendStats()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handshake reads and checks the request of a client.
+func (s *RemoteServer) handshake(br *bufio.Reader) (RemoteRequest, error) {
+	var req RemoteRequest
+	magic := make([]byte, len(remoteMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != remoteMagic {
+		return req, errors.New("pcap: not a remote capture client")
+	}
+	typ, payload, err := readFrame(br)
+	if err != nil {
+		return req, err
+	}
+	if typ != remoteOpen {
+		return req, fmt.Errorf("pcap: unexpected frame %d", typ)
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return req, fmt.Errorf("pcap: bad request: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(s.Token)) != 1 {
+		return req, errors.New("pcap: authentication failed")
+	}
+	allowed := false
+	for _, name := range s.Interfaces {
+		if name == req.Device {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return req, fmt.Errorf("pcap: interface %q not allowed", req.Device)
+	}
+	max := s.MaxSnapLen
+	if max <= 0 {
+		max = 65535
+	}
+	if req.SnapLen <= 0 || req.SnapLen > max {
+		req.SnapLen = max
+	}
+	return req, nil
+}
+
+// RemoteOptions controls a RemoteClient.
+type RemoteOptions struct {
+	// TLS, if set, is used to connect with TLS.
+	TLS *tls.Config
+
+	// Timeout is how long NextEx waits for a packet before returning 0,
+	// like the read timeout of OpenLive. Zero waits until a packet arrives.
+	Timeout time.Duration
+}
+
+// RemoteClient is a capture handle on a RemoteServer. It implements Handle
+// like a local Pcap. Packets the caller does not read fast enough are
+// dropped and counted in Getstats as PacketsDropped. Unlike those of Pcap,
+// the packets of a RemoteClient do not alias internal buffers.
+type RemoteClient struct {
+	conn     net.Conn
+	bw       *bufio.Writer
+	wmu      sync.Mutex
+	fmu      sync.Mutex // one SetFilter at a time
+	datalink int
+	timeout  time.Duration
+
+	pkts      chan *Packet
+	filterRes chan string
+	brk       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	stats   Stat
+	dropped uint32
+	err     error
+	closed  bool
+}
+
+// DialRemote connects to the RemoteServer at addr and opens the capture
+// described by req.
+func DialRemote(addr string, req RemoteRequest, opts RemoteOptions) (*RemoteClient, error) {
+	dialer := &net.Dialer{Timeout: remoteHandshake}
+	var conn net.Conn
+	var err error
+	if opts.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, opts.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := newRemoteClient(conn, req, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newRemoteClient(conn net.Conn, req RemoteRequest, opts RemoteOptions) (*RemoteClient, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+	conn.SetDeadline(time.Now().Add(remoteHandshake))
+	bw.WriteString(remoteMagic)
+	if err := writeFrame(bw, remoteOpen, payload); err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	typ, payload, err := readFrame(br)
+	switch {
+	case err != nil:
+		return nil, err
+	case typ == remoteError:
+		return nil, fmt.Errorf("pcap: remote: %s", payload)
+	case typ != remoteReady || len(payload) < 4:
+		return nil, fmt.Errorf("pcap: unexpected frame %d", typ)
+	}
+	conn.SetDeadline(time.Time{})
+	c := &RemoteClient{
+		conn:      conn,
+		bw:        bw,
+		datalink:  int(binary.BigEndian.Uint32(payload)),
+		timeout:   opts.Timeout,
+		pkts:      make(chan *Packet, remoteQueue),
+		filterRes: make(chan string, 1),
+		brk:       make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go c.read(br)
+	return c, nil
+}
+
+// read receives the frames of the server until the capture ends.
+func (c *RemoteClient) read(br *bufio.Reader) {
+	defer close(c.done)
+	defer close(c.pkts)
+	for {
+		typ, payload, err := readFrame(br)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		switch typ {
+		case remotePacket:
+			pkt, err := parseRemotePacket(payload)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			select {
+			case c.pkts <- pkt:
+			default:
+				c.mu.Lock()
+				c.dropped++
+				c.mu.Unlock()
+			}
+		case remoteStats:
+			if len(payload) < 12 {
+				c.fail(errors.New("pcap: short stats frame"))
+				return
+			}
+			c.mu.Lock()
+			c.stats = Stat{
+				PacketsReceived:  binary.BigEndian.Uint32(payload[0:]),
+				PacketsDropped:   binary.BigEndian.Uint32(payload[4:]),
+				PacketsIfDropped: binary.BigEndian.Uint32(payload[8:]),
+			}
+			c.mu.Unlock()
+		case remoteFilterResult:
+			// SetFilter waits for one result at a time.
+			select {
+			case c.filterRes <- string(payload):
+			default:
+				c.fail(errors.New("pcap: unexpected filter result"))
+				return
+			}
+		case remoteError:
+			c.fail(fmt.Errorf("pcap: remote: %s", payload))
+			return
+		case remoteEOF:
+			return
+		}
+	}
+}
+
+// fail records the error that ended the capture, unless the client was
+// closed.
+func (c *RemoteClient) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil && !c.closed {
+		c.err = err
+	}
+}
+
+// NextEx returns the next packet like Pcap.NextEx. pktin, if not nil, is
+// reused.
+func (c *RemoteClient) NextEx(pktin *Packet) (*Packet, int32) {
+	pkt := pktin
+	if pkt == nil {
+		pkt = new(Packet)
+	}
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		t := time.NewTimer(c.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p, ok := <-c.pkts:
+		if !ok {
+			if c.Geterror() != nil {
+				return pkt, -1
+			}
+			return pkt, -2
+		}
+		*pkt = Packet{data: pkt.data, iphdr: pkt.iphdr, ip6hdr: pkt.ip6hdr, tcphdr: pkt.tcphdr}
+		pkt.Time, pkt.Caplen, pkt.Len, pkt.Partial = p.Time, p.Caplen, p.Len, p.Partial
+		pkt.LinkType, pkt.Data = p.LinkType, p.Data
+		return pkt, 1
+	case <-c.brk:
+		return pkt, -2
+	case <-timeout:
+		return pkt, 0
+	}
+}
+
+// Next returns the next packet, or nil on timeout, error or end of the
+// capture.
+func (c *RemoteClient) Next() *Packet {
+	if pkt, r := c.NextEx(nil); r > 0 {
+		return pkt
+	}
+	return nil
+}
+
+// SetFilter replaces the filter of the remote handle.
+func (c *RemoteClient) SetFilter(expr string) error {
+	c.fmu.Lock()
+	defer c.fmu.Unlock()
+	c.wmu.Lock()
+	err := writeFrame(c.bw, remoteFilter, []byte(expr))
+	if err == nil {
+		err = c.bw.Flush()
+	}
+	c.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case res := <-c.filterRes:
+		if res != "" {
+			return fmt.Errorf("pcap: remote: %s", res)
+		}
+		return nil
+	case <-c.done:
+		return errors.New("pcap: remote capture ended")
+	}
+}
+
+// Getstats returns the statistics last sent by the server, with the
+// packets dropped by the client added to PacketsDropped.
+func (c *RemoteClient) Getstats() (*Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.PacketsDropped += c.dropped
+	return &st, nil
+}
+
+// Datalink returns the link type of the packets the remote handle delivers.
+func (c *RemoteClient) Datalink() int { return c.datalink }
+
+// Geterror returns the error that ended the capture, or nil.
+func (c *RemoteClient) Geterror() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// BreakLoop makes a NextEx blocked in another goroutine return -2.
+func (c *RemoteClient) BreakLoop() {
+	select {
+	case c.brk <- struct{}{}:
+	default:
+	}
+}
+
+// cancelBreak withdraws a BreakLoop no NextEx has reported.
+func (c *RemoteClient) cancelBreak() {
+	select {
+	case <-c.brk:
+	default:
+	}
+}
+
+// Close ends the capture and closes the connection.
+func (c *RemoteClient) Close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		c.wmu.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if writeFrame(c.bw, remoteClose, nil) == nil {
+			c.bw.Flush()
+		}
+		c.wmu.Unlock()
+		c.conn.Close()
+		<-c.done
+	})
+}
+
+// appendRemotePacket appends the payload of a packet frame: seconds as
+// int64, nanoseconds, original length, bytes cut off by Pcap and link type
+// as uint32, then the data.
+func appendRemotePacket(b []byte, pkt *Packet) []byte {
+	var h [remotePacketHdr]byte
+	binary.BigEndian.PutUint64(h[0:], uint64(pkt.Time.Unix()))
+	binary.BigEndian.PutUint32(h[8:], uint32(pkt.Time.Nanosecond()))
+	binary.BigEndian.PutUint32(h[12:], pkt.Len)
+	binary.BigEndian.PutUint32(h[16:], pkt.Partial)
+	binary.BigEndian.PutUint32(h[20:], uint32(pkt.LinkType))
+	return append(append(b, h[:]...), pkt.Data...)
+}
+
+func parseRemotePacket(b []byte) (*Packet, error) {
+	if len(b) < remotePacketHdr {
+		return nil, errors.New("pcap: short packet frame")
+	}
+	data := b[remotePacketHdr:]
+	return &Packet{
+		Time:     time.Unix(int64(binary.BigEndian.Uint64(b[0:])), int64(binary.BigEndian.Uint32(b[8:]))),
+		Len:      binary.BigEndian.Uint32(b[12:]),
+		Partial:  binary.BigEndian.Uint32(b[16:]),
+		LinkType: int(binary.BigEndian.Uint32(b[20:])),
+		Caplen:   uint32(len(data)),
+		Data:     data,
+	}, nil
+}
+
+func writeFrame(w *bufio.Writer, typ byte, payload []byte) error {
+	var h [5]byte
+	h[0] = typ
+	binary.BigEndian.PutUint32(h[1:], uint32(len(payload)))
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var h [5]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(h[1:])
+	if n > maxRemoteFrame {
+		return 0, nil, fmt.Errorf("pcap: frame of %d bytes exceeds limit", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return h[0], payload, nil
+}
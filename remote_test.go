@@ -0,0 +1,327 @@
+package pcap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHandle delivers its packets, then times out until the filter "eof"
+// is set or BreakLoop is called.
+type fakeHandle struct {
+	mu     sync.Mutex
+	pkts   []*Packet
+	eof    bool
+	broken bool
+	closed chan struct{}
+}
+
+func (h *fakeHandle) Next() *Packet {
+	pkt, _ := h.NextEx(nil)
+	return pkt
+}
+
+func (h *fakeHandle) NextEx(pkt *Packet) (*Packet, int32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case h.broken:
+		h.broken = false
+		return pkt, -2
+	case len(h.pkts) > 0:
+		pkt, h.pkts = h.pkts[0], h.pkts[1:]
+		return pkt, 1
+	case h.eof:
+		return pkt, -2
+	}
+	h.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	h.mu.Lock()
+	return pkt, 0
+}
+
+func (h *fakeHandle) SetFilter(expr string) error {
+	if expr == "eof" {
+		h.mu.Lock()
+		h.eof = true
+		h.mu.Unlock()
+		return nil
+	}
+	return errors.New("syntax error")
+}
+
+func (h *fakeHandle) Getstats() (*Stat, error) {
+	return &Stat{PacketsReceived: 7, PacketsDropped: 1}, nil
+}
+func (h *fakeHandle) Datalink() int   { return LINKTYPE_RAW }
+func (h *fakeHandle) Geterror() error { return nil }
+func (h *fakeHandle) Close()          { close(h.closed) }
+func (h *fakeHandle) BreakLoop() {
+	h.mu.Lock()
+	h.broken = true
+	h.mu.Unlock()
+}
+
+func remoteServer(t *testing.T, s *RemoteServer) (string, chan *fakeHandle) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	handles := make(chan *fakeHandle, 1)
+	s.Open = func(req RemoteRequest) (Handle, error) {
+		h := &fakeHandle{closed: make(chan struct{})}
+		for i := 0; i < 3; i++ {
+			h.pkts = append(h.pkts, &Packet{
+				Time:     time.Unix(1500000000, int64(i)),
+				Len:      100,
+				Caplen:   uint32(i + 1),
+				LinkType: LINKTYPE_RAW,
+				Data:     bytes.Repeat([]byte{byte(i)}, i+1),
+			})
+		}
+		handles <- h
+		return h, nil
+	}
+	go s.Serve(l)
+	return l.Addr().String(), handles
+}
+
+func TestRemote(t *testing.T) {
+	addr, handles := remoteServer(t, &RemoteServer{Token: "secret", Interfaces: []string{"lo"}})
+	c, err := DialRemote(addr, RemoteRequest{Token: "secret", Device: "lo"}, RemoteOptions{Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h := <-handles
+	if c.Datalink() != LINKTYPE_RAW {
+		t.Errorf("Datalink %d", c.Datalink())
+	}
+	var pkt *Packet
+	for i := 0; i < 3; i++ {
+		var r int32
+		for r == 0 {
+			pkt, r = c.NextEx(pkt)
+		}
+		if r != 1 || !pkt.Time.Equal(time.Unix(1500000000, int64(i))) || pkt.Len != 100 ||
+			int(pkt.Caplen) != i+1 || !bytes.Equal(pkt.Data, bytes.Repeat([]byte{byte(i)}, i+1)) {
+			t.Fatalf("packet %d: result %d, %+v", i, r, pkt)
+		}
+	}
+	if _, r := c.NextEx(pkt); r != 0 {
+		t.Fatalf("got result %d, want a timeout", r)
+	}
+	if err := c.SetFilter("bogus"); err == nil {
+		t.Fatal("bad filter accepted")
+	}
+	if err := c.SetFilter("eof"); err != nil {
+		t.Fatal(err)
+	}
+	r := int32(0)
+	for r == 0 {
+		_, r = c.NextEx(pkt)
+	}
+	if r != -2 || c.Geterror() != nil {
+		t.Fatalf("got result %d err %v at end of capture", r, c.Geterror())
+	}
+	if st, _ := c.Getstats(); st.PacketsReceived != 7 || st.PacketsDropped != 1 {
+		t.Fatalf("got stats %+v", st)
+	}
+	select {
+	case <-h.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handle not closed")
+	}
+}
+
+func TestRemoteCapture(t *testing.T) {
+	addr, _ := remoteServer(t, &RemoteServer{Token: "secret", Interfaces: []string{"lo"}})
+	c, err := DialRemote(addr, RemoteRequest{Token: "secret", Device: "lo"}, RemoteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Without a read timeout only the watcher's BreakLoop ends the capture.
+	sum, err := Capture(context.Background(), c, Limits{Idle: 100 * time.Millisecond}, func(*Packet) error { return nil })
+	if err != nil || sum.Packets != 3 || sum.Reason != StopIdle {
+		t.Fatalf("got %+v err %v", sum, err)
+	}
+	// With a read timeout the capture may see the idle limit before the
+	// watcher's break is read, which must not end the next read.
+	c.timeout = time.Millisecond
+	for i := 0; i < 20; i++ {
+		if _, err := Capture(context.Background(), c, Limits{Idle: 5 * time.Millisecond}, func(*Packet) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if _, r := c.NextEx(nil); r != 0 {
+			t.Fatalf("got result %d after Capture, want a timeout", r)
+		}
+	}
+}
+
+func TestRemoteRefused(t *testing.T) {
+	addr, _ := remoteServer(t, &RemoteServer{Token: "secret", Interfaces: []string{"lo"}})
+	for _, req := range []RemoteRequest{
+		{Token: "wrong", Device: "lo"},
+		{Token: "secret", Device: "eth0"},
+	} {
+		if c, err := DialRemote(addr, req, RemoteOptions{}); err == nil {
+			c.Close()
+			t.Errorf("request %+v accepted", req)
+		}
+	}
+	if err := (&RemoteServer{}).Serve(nil); err == nil {
+		t.Error("server without token started")
+	}
+}
+
+func TestRemoteUnexpectedFilterResult(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br, bw := bufio.NewReader(conn), bufio.NewWriter(conn)
+		if _, err := br.Discard(len(remoteMagic)); err != nil {
+			return
+		}
+		if _, _, err := readFrame(br); err != nil {
+			return
+		}
+		writeFrame(bw, remoteReady, make([]byte, 4))
+		writeFrame(bw, remoteFilterResult, nil)
+		writeFrame(bw, remoteFilterResult, nil)
+		bw.Flush()
+		readFrame(br)
+	}()
+
+	c, err := DialRemote(l.Addr().String(), RemoteRequest{Token: "secret", Device: "lo"}, RemoteOptions{Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	r := int32(0)
+	for r >= 0 && time.Now().Before(deadline) {
+		_, r = c.NextEx(nil)
+	}
+	if r != -1 || c.Geterror() == nil {
+		t.Errorf("got result %d err:%v", r, c.Geterror())
+	}
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hung")
+	}
+}
+
+func TestRemoteTLSClose(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	addr, handles := remoteServer(t, &RemoteServer{Token: "secret", Interfaces: []string{"lo"}, TLSConfig: server})
+	if _, err := DialRemote(addr, RemoteRequest{Token: "secret", Device: "lo"}, RemoteOptions{}); err == nil {
+		t.Fatal("plain client accepted by TLS server")
+	}
+	c, err := DialRemote(addr, RemoteRequest{Token: "secret", Device: "lo"}, RemoteOptions{TLS: &tls.Config{RootCAs: pool}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt := c.Next(); pkt == nil || len(pkt.Data) != 1 {
+		t.Fatalf("got %+v", pkt)
+	}
+	h := <-handles
+	c.Close()
+	select {
+	case <-h.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handle not closed after client Close")
+	}
+}
+
+func TestPcapRemote(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go (&RemoteServer{Token: "secret", Interfaces: []string{"lo"}}).Serve(l)
+
+	port, numPkts := 54324, 5
+	c, err := DialRemote(l.Addr().String(), RemoteRequest{
+		Token:  "secret",
+		Device: "lo",
+		Filter: fmt.Sprintf("udp dst port %d", port),
+	}, RemoteOptions{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go udpSvr(port, numPkts, t)
+	go udpClient(port, numPkts, 1*time.Second, t)
+
+	n := 0
+	deadline := time.Now().Add(10 * time.Second)
+	for pkt, r := c.NextEx(nil); n < numPkts && r >= 0 && time.Now().Before(deadline); pkt, r = c.NextEx(pkt) {
+		if r > 0 {
+			n++
+			if pkt.LinkType != c.Datalink() {
+				t.Errorf("packet link type %d, Datalink %d", pkt.LinkType, c.Datalink())
+			}
+		}
+	}
+	if n != numPkts {
+		t.Fatalf("received %d of %d packets err:%v", n, numPkts, c.Geterror())
+	}
+
+	// Replacing the filter must not end the stream.
+	if err := c.SetFilter(fmt.Sprintf("udp dst port %d", port+1)); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(500 * time.Millisecond); time.Now().Before(deadline); {
+		if _, r := c.NextEx(nil); r < 0 {
+			t.Fatalf("got result %d after SetFilter err:%v", r, c.Geterror())
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package pcap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RingConfig bounds the packets a Ring keeps. Each non-zero limit applies;
+// at least one must be set. Durations are measured between packet
+// timestamps. After a Trigger, added packets are written to the dump file
+// as well until both the next PostPackets packets and PostDuration from
+// the newest packet at the Trigger have passed.
+type RingConfig struct {
+	Packets  int
+	Duration time.Duration
+	Bytes    int
+
+	PostPackets  int
+	PostDuration time.Duration
+
+	Dir string // directory for dump files, defaults to os.TempDir()
+}
+
+// Ring keeps copies of the most recent packets of a stream in memory and
+// writes them to a pcap file on demand.
+type Ring struct {
+	cfg    RingConfig
+	header FileHeader
+
+	mu    sync.Mutex
+	pkts  []*Packet // circular, oldest at head
+	head  int
+	count int
+	bytes int
+
+	dump *ringDump
+}
+
+type ringDump struct {
+	path     string
+	file     *os.File
+	buf      *bufio.Writer
+	w        *Writer
+	left     int       // post-trigger packets still to write
+	deadline time.Time // end of the post-trigger window, zero until a packet is seen
+}
+
+// NewRing returns an empty Ring. Dump files are written with header.
+func NewRing(cfg RingConfig, header FileHeader) (*Ring, error) {
+	if cfg.Packets <= 0 && cfg.Duration <= 0 && cfg.Bytes <= 0 {
+		return nil, errors.New("pcap: ring needs a packet, duration or byte limit")
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = os.TempDir()
+	}
+	return &Ring{cfg: cfg, header: header}, nil
+}
+
+// Add stores a copy of pkt, evicting the oldest packets beyond the limits,
+// and writes it to the dump file while a post-trigger window is open.
+func (r *Ring) Add(pkt *Packet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := pkt.Clone()
+	r.push(c)
+	r.evict(c.Time)
+
+	if d := r.dump; d != nil {
+		if d.deadline.IsZero() {
+			d.deadline = c.Time.Add(r.cfg.PostDuration)
+		}
+		if d.left <= 0 && !c.Time.Before(d.deadline) {
+			return r.finish()
+		}
+		d.left--
+		if err := d.w.Write(c); err != nil {
+			r.finish()
+			return err
+		}
+	}
+	return nil
+}
+
+// Trigger writes the packets in the ring to a new file in the configured
+// directory and keeps the file open for the post-trigger window. It returns
+// the path of the file. Triggering again while a window is open extends the
+// window of the current file.
+func (r *Ring) Trigger(reason string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deadline time.Time
+	if r.count > 0 {
+		deadline = r.pkts[(r.head+r.count-1)%len(r.pkts)].Time.Add(r.cfg.PostDuration)
+	}
+	if d := r.dump; d != nil {
+		d.left = r.cfg.PostPackets
+		d.deadline = deadline
+		return d.path, nil
+	}
+
+	name := fmt.Sprintf("ring-%s-%s", time.Now().Format("20060102-150405.000"), sanitizeReason(reason))
+	f, path, err := createNew(r.cfg.Dir, name, ".pcap")
+	if err != nil {
+		return "", err
+	}
+	d := &ringDump{
+		path:     path,
+		file:     f,
+		buf:      bufio.NewWriter(f),
+		left:     r.cfg.PostPackets,
+		deadline: deadline,
+	}
+	r.dump = d
+	if d.w, err = NewWriter(d.buf, &r.header); err != nil {
+		r.finish()
+		return "", err
+	}
+	for i := 0; i < r.count; i++ {
+		if err = d.w.Write(r.pkts[(r.head+i)%len(r.pkts)]); err != nil {
+			r.finish()
+			return "", err
+		}
+	}
+	if err = d.buf.Flush(); err != nil {
+		r.finish()
+		return "", err
+	}
+	if r.cfg.PostPackets <= 0 && r.cfg.PostDuration <= 0 {
+		return path, r.finish()
+	}
+	return path, nil
+}
+
+// Close ends an open post-trigger window and closes its file.
+func (r *Ring) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.finish()
+}
+
+// Len returns the number of packets and bytes in the ring.
+func (r *Ring) Len() (packets, bytes int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count, r.bytes
+}
+
+func (r *Ring) finish() error {
+	d := r.dump
+	if d == nil {
+		return nil
+	}
+	r.dump = nil
+	err := d.buf.Flush()
+	if cerr := d.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (r *Ring) push(pkt *Packet) {
+	if r.count == len(r.pkts) {
+		// Grow, unrolling the circular buffer.
+		n := 2 * len(r.pkts)
+		if n == 0 {
+			n = 64
+		}
+		if r.cfg.Packets > 0 && n > r.cfg.Packets+1 {
+			n = r.cfg.Packets + 1
+		}
+		pkts := make([]*Packet, n)
+		for i := 0; i < r.count; i++ {
+			pkts[i] = r.pkts[(r.head+i)%len(r.pkts)]
+		}
+		r.pkts = pkts
+		r.head = 0
+	}
+	r.pkts[(r.head+r.count)%len(r.pkts)] = pkt
+	r.count++
+	r.bytes += len(pkt.Data)
+}
+
+func (r *Ring) evict(now time.Time) {
+	for r.count > 0 {
+		oldest := r.pkts[r.head]
+		if !(r.cfg.Packets > 0 && r.count > r.cfg.Packets) &&
+			!(r.cfg.Bytes > 0 && r.bytes > r.cfg.Bytes) &&
+			!(r.cfg.Duration > 0 && now.Sub(oldest.Time) > r.cfg.Duration) {
+			return
+		}
+		r.pkts[r.head] = nil
+		r.head = (r.head + 1) % len(r.pkts)
+		r.count--
+		r.bytes -= len(oldest.Data)
+	}
+}
+
+// createNew creates the file name+ext in dir, numbering the name if a file
+// of that name exists.
+func createNew(dir, name, ext string) (*os.File, string, error) {
+	for i := 0; ; i++ {
+		path := filepath.Join(dir, name+ext)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", name, i, ext))
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return f, path, err
+		}
+	}
+}
+
+func sanitizeReason(reason string) string {
+	s := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+			return c
+		}
+		return '_'
+	}, reason)
+	if len(s) > 64 {
+		s = s[:64]
+	}
+	if s == "" {
+		s = "trigger"
+	}
+	return s
+}
@@ -0,0 +1,97 @@
+package pcap
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// ringPayloads returns the last payload byte of each packet in the file.
+func ringPayloads(t *testing.T, path string) []int {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rd, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for p := rd.Next(); p != nil; p = rd.Next() {
+		got = append(got, int(p.Data[len(p.Data)-1]))
+	}
+	return got
+}
+
+func TestRingTrigger(t *testing.T) {
+	dir := t.TempDir()
+	header := FileHeader{MagicNumber: TCPDUMP_MAGIC, VersionMajor: 2, VersionMinor: 4, SnapLen: 65535, LinkType: LINKTYPE_ETHERNET}
+	r, err := NewRing(RingConfig{Packets: 10, PostPackets: 2, Dir: dir}, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1500000000, 0)
+	pkt := udpPacket(start, 1, 2, 1, 2, []byte("x"))
+	for i := 0; i < 100; i++ {
+		pkt.Time = start.Add(time.Duration(i) * time.Millisecond)
+		pkt.Data[len(pkt.Data)-1] = byte(i)
+		r.Add(pkt)
+	}
+	if n, _ := r.Len(); n != 10 {
+		t.Fatalf("ring holds %d packets", n)
+	}
+	path, err := r.Trigger("alert #1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 103; i++ {
+		pkt.Data[len(pkt.Data)-1] = byte(i)
+		r.Add(pkt)
+	}
+	r.Close()
+
+	want := []int{90, 91, 92, 93, 94, 95, 96, 97, 98, 99, 100, 101}
+	if got := ringPayloads(t, path); !equalInts(got, want) {
+		t.Fatalf("dump holds %v, want %v", got, want)
+	}
+
+	again, err := r.Trigger("alert #1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if again == path {
+		t.Fatalf("second dump overwrote %s", path)
+	}
+}
+
+func TestRingPostDuration(t *testing.T) {
+	header := FileHeader{MagicNumber: TCPDUMP_MAGIC, VersionMajor: 2, VersionMinor: 4, SnapLen: 65535, LinkType: LINKTYPE_ETHERNET}
+	r, err := NewRing(RingConfig{Packets: 2, PostPackets: 1, PostDuration: 5 * time.Second, Dir: t.TempDir()}, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1500000000, 0)
+	pkt := udpPacket(start, 1, 2, 1, 2, []byte("x"))
+	add := func(i int) {
+		pkt.Time = start.Add(time.Duration(i) * time.Second)
+		pkt.Data[len(pkt.Data)-1] = byte(i)
+		r.Add(pkt)
+	}
+	add(0)
+	add(1)
+	path, err := r.Trigger("late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The window ends 5s after the newest packet, at 6s, well after the
+	// one post-trigger packet.
+	for i := 2; i < 10; i++ {
+		add(i)
+	}
+	r.Close()
+	if got, want := ringPayloads(t, path), []int{0, 1, 2, 3, 4, 5}; !equalInts(got, want) {
+		t.Fatalf("dump holds %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,333 @@
+package pcap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RotateConfig controls when a RotatingWriter starts a new file and which
+// old files it keeps. Times are packet timestamps.
+type RotateConfig struct {
+	// Template names the files. It is expanded with strftime conversions
+	// (%Y %y %m %d %j %H %M %S %s %%) for the timestamp of the first packet
+	// of the file, and %n for a sequence number starting at 0. Defaults to
+	// "capture-%Y%m%d-%H%M%S-%n.pcap". Existing files are not overwritten:
+	// if the name is taken, a number is added, as in capture-1.pcap.
+	Template string
+
+	Size     int64         // start a new file once one holds this many bytes, like tcpdump -C
+	Interval time.Duration // start a new file at every multiple of Interval, like tcpdump -G
+
+	// MaxFiles and MaxBytes limit the files kept, counting the one being
+	// written. The oldest completed files are deleted to stay within them.
+	MaxFiles int
+	MaxBytes int64
+
+	// OnClose, if set, is called with the path of each completed file
+	// before it can be deleted by MaxFiles or MaxBytes.
+	OnClose func(path string)
+
+	Options WriterOptions // for files written with a Writer
+}
+
+// RotatingWriter writes packets to a series of pcap files. Every file
+// starts with a file header. Only files created by the RotatingWriter are
+// deleted.
+type RotatingWriter struct {
+	cfg  RotateConfig
+	open func(f *os.File, path string) (rotatingFile, error)
+
+	cur   rotatingFile
+	path  string
+	slot  time.Time
+	seq   int
+	files []string // completed files, oldest first
+	sizes []int64
+	total int64
+}
+
+// rotatingFile is an open output file of a RotatingWriter.
+type rotatingFile interface {
+	PacketWriteCloser
+	Size() int64
+}
+
+// NewRotatingWriter returns a RotatingWriter that writes files with a
+// Writer and header. The first file is created by the first Write.
+func NewRotatingWriter(cfg RotateConfig, header FileHeader) (*RotatingWriter, error) {
+	return newRotatingWriter(cfg, func(f *os.File, path string) (rotatingFile, error) {
+		return newWriterFile(f, &header, cfg.Options)
+	})
+}
+
+// NewRotatingDumper returns a RotatingWriter that writes files through
+// libpcap with p.DumpOpen. cfg.Options does not apply.
+func NewRotatingDumper(p *Pcap, cfg RotateConfig) (*RotatingWriter, error) {
+	return newRotatingWriter(cfg, func(f *os.File, path string) (rotatingFile, error) {
+		// libpcap opens the file again by name.
+		f.Close()
+		d, err := p.DumpOpen(&path)
+		if err != nil {
+			return nil, err
+		}
+		return &dumperFile{d: d}, nil
+	})
+}
+
+func newRotatingWriter(cfg RotateConfig, open func(*os.File, string) (rotatingFile, error)) (*RotatingWriter, error) {
+	if cfg.Size < 0 || cfg.Interval < 0 || cfg.MaxFiles < 0 || cfg.MaxBytes < 0 {
+		return nil, errors.New("pcap: negative rotation limit")
+	}
+	if cfg.Template == "" {
+		cfg.Template = "capture-%Y%m%d-%H%M%S-%n.pcap"
+	}
+	return &RotatingWriter{cfg: cfg, open: open}, nil
+}
+
+// Write writes pkt, first starting a new file if a limit was reached.
+func (w *RotatingWriter) Write(pkt *Packet) error {
+	if w.cur != nil && w.due(pkt.Time) {
+		if err := w.finish(); err != nil {
+			return err
+		}
+	}
+	if w.cur == nil {
+		if err := w.create(pkt.Time); err != nil {
+			return err
+		}
+	}
+	if err := w.cur.Write(pkt); err != nil {
+		return err
+	}
+	return w.prune()
+}
+
+// Path returns the path of the file being written, or "".
+func (w *RotatingWriter) Path() string {
+	if w.cur == nil {
+		return ""
+	}
+	return w.path
+}
+
+// Close completes the current file.
+func (w *RotatingWriter) Close() error {
+	if w.cur == nil {
+		return nil
+	}
+	return w.finish()
+}
+
+func (w *RotatingWriter) due(t time.Time) bool {
+	if w.cfg.Size > 0 && w.cur.Size() >= w.cfg.Size {
+		return true
+	}
+	return w.cfg.Interval > 0 && !t.Truncate(w.cfg.Interval).Equal(w.slot)
+}
+
+func (w *RotatingWriter) create(t time.Time) error {
+	name := strftime(w.cfg.Template, t, w.seq)
+	w.seq++
+	dir := filepath.Dir(name)
+	if dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	// The template may repeat a name, or name a file of an earlier run.
+	base := filepath.Base(name)
+	ext := filepath.Ext(base)
+	f, path, err := createNew(dir, strings.TrimSuffix(base, ext), ext)
+	if err != nil {
+		return err
+	}
+	rf, err := w.open(f, path)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	w.cur, w.path = rf, path
+	if w.cfg.Interval > 0 {
+		w.slot = t.Truncate(w.cfg.Interval)
+	}
+	return nil
+}
+
+// finish closes the current file, reports it and applies the retention
+// limits.
+func (w *RotatingWriter) finish() error {
+	err := w.cur.Close()
+	size := w.cur.Size()
+	w.cur = nil
+	// A file that failed to close still counts and is pruned in turn.
+	w.files = append(w.files, w.path)
+	w.sizes = append(w.sizes, size)
+	w.total += size
+	if err != nil {
+		w.prune()
+		return fmt.Errorf("pcap: closing %s: %w", w.path, err)
+	}
+	if w.cfg.OnClose != nil {
+		w.cfg.OnClose(w.path)
+	}
+	return w.prune()
+}
+
+// prune deletes the oldest completed files until they and the current
+// file fit the retention limits.
+func (w *RotatingWriter) prune() error {
+	files, total := len(w.files), w.total
+	if w.cur != nil {
+		files++
+		total += w.cur.Size()
+	}
+	var err error
+	for len(w.files) > 0 &&
+		(w.cfg.MaxFiles > 0 && files > w.cfg.MaxFiles ||
+			w.cfg.MaxBytes > 0 && total > w.cfg.MaxBytes) {
+		if rerr := os.Remove(w.files[0]); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+			err = rerr
+		}
+		files--
+		total -= w.sizes[0]
+		w.total -= w.sizes[0]
+		w.files, w.sizes = w.files[1:], w.sizes[1:]
+	}
+	return err
+}
+
+// strftime expands the conversions of RotateConfig.Template.
+func strftime(layout string, t time.Time, seq int) string {
+	var b strings.Builder
+	for i := 0; i < len(layout); i++ {
+		c := layout[i]
+		if c != '%' || i+1 == len(layout) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch layout[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 's':
+			b.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case 'n':
+			b.WriteString(strconv.Itoa(seq))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(layout[i])
+		}
+	}
+	return b.String()
+}
+
+// writerFile is a rotatingFile written with a Writer.
+type writerFile struct {
+	file *os.File
+	buf  *bufio.Writer
+	w    *Writer
+	size int64
+}
+
+// createWriterFile creates the pcap file at path, which must not exist. With
+// opts.Append it appends to the file instead, creating it and writing the
+// header if it does not exist or is empty.
+func createWriterFile(path string, header *FileHeader, opts WriterOptions) (*writerFile, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if opts.Append {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Append {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		opts.Append = fi.Size() > 0
+	}
+	return newWriterFile(f, header, opts)
+}
+
+// newWriterFile writes a pcap file to f. f is closed on error.
+func newWriterFile(f *os.File, header *FileHeader, opts WriterOptions) (*writerFile, error) {
+	var err error
+	wf := &writerFile{file: f}
+	wf.buf = bufio.NewWriter(countWriter{f, &wf.size})
+	if wf.w, err = NewWriterOptions(wf.buf, header, opts); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return wf, nil
+}
+
+func (f *writerFile) Write(pkt *Packet) error { return f.w.Write(pkt) }
+
+// Size counts buffered bytes too, like PcapDumper.Ftell.
+func (f *writerFile) Size() int64 { return f.size + int64(f.buf.Buffered()) }
+
+func (f *writerFile) Close() error {
+	err := f.w.Close()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	*c.n += int64(n)
+	return n, err
+}
+
+// dumperFile is a rotatingFile written through libpcap.
+type dumperFile struct {
+	d    *PcapDumper
+	size int64 // at Close
+}
+
+func (f *dumperFile) Write(pkt *Packet) error { return f.d.WritePacket(pkt) }
+
+func (f *dumperFile) Size() int64 {
+	if n, err := f.d.Ftell(); err == nil {
+		return n
+	}
+	return f.size
+}
+
+func (f *dumperFile) Close() error {
+	f.size = f.Size()
+	return f.d.Close()
+}
@@ -0,0 +1,142 @@
+package pcap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingWriter(t *testing.T) {
+	dir := t.TempDir()
+	var closed []string
+	w, err := NewRotatingWriter(RotateConfig{
+		Template: filepath.Join(dir, "cap-%H%M%S-%n.pcap"),
+		Size:     24 + 4*(16+42),
+		Interval: time.Minute,
+		MaxFiles: 2,
+		OnClose:  func(path string) { closed = append(closed, path) },
+	}, *testHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 2, 3, 4, 50, 0, time.UTC)
+	// Files of four, four and one packets, then two in the next minute.
+	for i := 0; i < 11; i++ {
+		ts := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		if i >= 9 {
+			ts = start.Add(10 * time.Second)
+		}
+		if err := w.Write(udpPacket(ts, 1, 2, uint16(i), 53, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Path() != filepath.Join(dir, "cap-030500-3.pcap") {
+		t.Fatalf("current file %s", w.Path())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cap-030450-0.pcap", "cap-030450-1.pcap", "cap-030450-2.pcap", "cap-030500-3.pcap"}
+	if len(closed) != len(want) {
+		t.Fatalf("closed %v", closed)
+	}
+	for i, name := range want {
+		if closed[i] != filepath.Join(dir, name) {
+			t.Fatalf("closed %v", closed)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pcap"))
+	if len(files) != 2 || files[0] != closed[2] || files[1] != closed[3] {
+		t.Fatalf("kept %v", files)
+	}
+	for i, path := range files {
+		f, _ := os.Open(path)
+		r, err := NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		n := 0
+		for pkt := r.Next(); pkt != nil; pkt = r.Next() {
+			n++
+		}
+		f.Close()
+		if n != i+1 {
+			t.Fatalf("%s: %d packets", path, n)
+		}
+	}
+}
+
+func TestRotatingWriterBudget(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := NewRotatingWriter(RotateConfig{
+		Template: filepath.Join(dir, "cap.pcap"),
+		Size:     1,
+		MaxBytes: 2 * (24 + 16 + 42),
+	}, *testHeader())
+	for i := 0; i < 5; i++ {
+		w.Write(udpPacket(time.Unix(int64(i), 0), 1, 2, uint16(i), 53, nil))
+		if files, _ := filepath.Glob(filepath.Join(dir, "cap*.pcap")); len(files) > 2 {
+			t.Fatalf("packet %d: %d files on disk", i, len(files))
+		}
+	}
+	w.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "cap*.pcap"))
+	if len(files) != 2 {
+		t.Fatalf("kept %v", files)
+	}
+}
+
+func TestRotatingWriterExisting(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "cap.pcap")
+	if err := os.WriteFile(old, []byte("earlier capture"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	w, _ := NewRotatingWriter(RotateConfig{Template: old, Size: 1}, *testHeader())
+	for i := 0; i < 2; i++ {
+		if err := w.Write(udpPacket(time.Unix(int64(i), 0), 1, 2, uint16(i), 53, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	if b, _ := os.ReadFile(old); string(b) != "earlier capture" {
+		t.Fatalf("existing file overwritten: %q", b)
+	}
+	for _, name := range []string{"cap-1.pcap", "cap-2.pcap"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	path := filepath.Join(dir, "append.pcap")
+	for i := 0; i < 2; i++ {
+		f, err := createWriterFile(path, testHeader(), WriterOptions{Append: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(udpPacket(time.Unix(int64(i), 0), 1, 2, uint16(i), 53, nil))
+		f.Close()
+	}
+	f, _ := os.Open(path)
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for r.Next() != nil {
+		n++
+	}
+	if n != 2 || r.Err() != nil {
+		t.Fatalf("appended file holds %d packets, err %v", n, r.Err())
+	}
+}
+
+func TestStrftime(t *testing.T) {
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	if s := strftime("%Y-%m-%d_%H:%M:%S %y %j %s %n %% %q", ts, 12); s != "2021-03-04_05:06:07 21 063 1614834367 12 % %q" {
+		t.Fatalf("strftime gave %q", s)
+	}
+}
@@ -0,0 +1,180 @@
+package pcap
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SampleMode selects how a Sampler picks packets.
+type SampleMode int
+
+const (
+	SampleAll    SampleMode = iota // keep every packet
+	SampleCount                    // keep every Nth packet
+	SampleRandom                   // keep each packet with probability 1/N
+	SampleFlow                     // keep whole flows whose hash is 0 mod N
+)
+
+// SamplerConfig configures a Sampler. N is the sampling rate for all modes
+// other than SampleAll. The rate limits are token buckets refilled by packet
+// timestamps; zero disables a limit. Burst is the bucket depth expressed as
+// time at the configured rate and defaults to one second.
+type SamplerConfig struct {
+	Mode SampleMode
+	N    uint32
+	Seed int64 // SampleRandom seed, SampleFlow hash salt
+
+	PacketsPerSec float64
+	BytesPerSec   float64
+	Burst         time.Duration
+}
+
+// SamplerStats counts what a Sampler did with the packets it read.
+type SamplerStats struct {
+	Seen        uint64 // packets read from the source
+	SeenBytes   uint64
+	Passed      uint64 // packets returned by Next
+	PassedBytes uint64
+	Sampled     uint64 // packets dropped by sampling
+	RateLimited uint64 // packets dropped by the rate limits
+}
+
+// Scale is the factor to multiply downstream packet counts by to estimate
+// the counts of the source.
+func (s SamplerStats) Scale() float64 {
+	if s.Passed == 0 {
+		return 0
+	}
+	return float64(s.Seen) / float64(s.Passed)
+}
+
+// Sampler wraps a PacketSource and drops packets by sampling and rate
+// limiting. Every packet it returns has SampleRate set to the configured N.
+type Sampler struct {
+	src PacketSource
+	cfg SamplerConfig
+	rnd *rand.Rand
+	cnt uint64
+
+	pkts  bucket
+	bytes bucket
+
+	mu    sync.Mutex
+	stats SamplerStats
+}
+
+// NewSampler returns a Sampler reading from src.
+func NewSampler(src PacketSource, cfg SamplerConfig) *Sampler {
+	if cfg.N == 0 || cfg.Mode == SampleAll {
+		cfg.N = 1
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = time.Second
+	}
+	burst := cfg.Burst.Seconds()
+	return &Sampler{
+		src:   src,
+		cfg:   cfg,
+		rnd:   rand.New(rand.NewSource(cfg.Seed)),
+		pkts:  bucket{rate: cfg.PacketsPerSec, depth: cfg.PacketsPerSec * burst},
+		bytes: bucket{rate: cfg.BytesPerSec, depth: cfg.BytesPerSec * burst},
+	}
+}
+
+// Next returns the next packet that passes sampling and rate limiting, or
+// nil when the source returns nil.
+func (s *Sampler) Next() *Packet {
+	for {
+		pkt := s.src.Next()
+		if pkt == nil {
+			return nil
+		}
+		if s.Keep(pkt) {
+			return pkt
+		}
+	}
+}
+
+// Keep reports whether pkt passes the sampler and updates the stats. It
+// lets the sampler be used on packets that are not read through Next.
+func (s *Sampler) Keep(pkt *Packet) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Seen++
+	s.stats.SeenBytes += uint64(pkt.Len)
+	if !s.sample(pkt) {
+		s.stats.Sampled++
+		return false
+	}
+	if !s.pkts.take(pkt.Time, 1) || !s.bytes.take(pkt.Time, float64(pkt.Len)) {
+		s.stats.RateLimited++
+		return false
+	}
+	s.stats.Passed++
+	s.stats.PassedBytes += uint64(pkt.Len)
+	pkt.SampleRate = s.cfg.N
+	return true
+}
+
+func (s *Sampler) sample(pkt *Packet) bool {
+	n := uint64(s.cfg.N)
+	if n <= 1 {
+		return true
+	}
+	switch s.cfg.Mode {
+	case SampleCount:
+		s.cnt++
+		return s.cnt%n == 0
+	case SampleRandom:
+		return s.rnd.Int63n(int64(n)) == 0
+	case SampleFlow:
+		key, ok := FlowKeyOf(pkt)
+		if !ok {
+			// Not IP, fall back to counting.
+			s.cnt++
+			return s.cnt%n == 0
+		}
+		return key.Hash(uint64(s.cfg.Seed))%n == 0
+	}
+	return true
+}
+
+// Stats returns a snapshot of the sampler counters.
+func (s *Sampler) Stats() SamplerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// bucket is a token bucket refilled at rate tokens per second of packet
+// time, holding at most depth tokens. A zero rate never limits.
+type bucket struct {
+	rate   float64
+	depth  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(now time.Time, n float64) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = b.depth
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.depth {
+			b.tokens = b.depth
+		}
+	}
+	if !now.Before(b.last) {
+		b.last = now
+	}
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
@@ -0,0 +1,120 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// udpPacket builds an Ethernet/IPv4/UDP frame between 10.0.0.src and
+// 10.0.0.dst.
+func udpPacket(ts time.Time, src, dst byte, sport, dport uint16, payload []byte) *Packet {
+	data := make([]byte, 14+20+8+len(payload))
+	binary.BigEndian.PutUint16(data[12:14], TYPE_IP)
+	ip := data[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+8+len(payload)))
+	ip[8] = 64
+	ip[9] = IP_UDP
+	copy(ip[12:16], []byte{10, 0, 0, src})
+	copy(ip[16:20], []byte{10, 0, 0, dst})
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp[0:2], sport)
+	binary.BigEndian.PutUint16(udp[2:4], dport)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	copy(udp[8:], payload)
+	return &Packet{
+		Time:     ts,
+		Caplen:   uint32(len(data)),
+		Len:      uint32(len(data)),
+		Data:     data,
+		LinkType: LINKTYPE_ETHERNET,
+	}
+}
+
+type sliceSource []*Packet
+
+func (s *sliceSource) Next() *Packet {
+	if len(*s) == 0 {
+		return nil
+	}
+	pkt := (*s)[0]
+	*s = (*s)[1:]
+	return pkt
+}
+
+func TestFlowKeyDirection(t *testing.T) {
+	now := time.Now()
+	a, ok := FlowKeyOf(udpPacket(now, 1, 2, 1000, 53, nil))
+	if !ok {
+		t.Fatal("no flow key")
+	}
+	b, _ := FlowKeyOf(udpPacket(now, 2, 1, 53, 1000, nil))
+	if a != b {
+		t.Fatalf("flow keys differ: %s != %s", a, b)
+	}
+}
+
+func TestSamplerCount(t *testing.T) {
+	var src sliceSource
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		src = append(src, udpPacket(now, 1, 2, uint16(i), 53, nil))
+	}
+	s := NewSampler(&src, SamplerConfig{Mode: SampleCount, N: 10})
+	n := 0
+	for pkt := s.Next(); pkt != nil; pkt = s.Next() {
+		if pkt.SampleRate != 10 {
+			t.Fatalf("SampleRate %d", pkt.SampleRate)
+		}
+		n++
+	}
+	if st := s.Stats(); n != 10 || st.Seen != 100 || st.Scale() != 10 {
+		t.Fatalf("passed %d, stats %+v", n, st)
+	}
+}
+
+func TestSamplerFlow(t *testing.T) {
+	var src sliceSource
+	now := time.Now()
+	for i := 0; i < 50; i++ {
+		for f := 0; f < 20; f++ {
+			src = append(src, udpPacket(now, 1, 2, uint16(1000+f), 53, nil))
+		}
+	}
+	s := NewSampler(&src, SamplerConfig{Mode: SampleFlow, N: 4, Seed: 7})
+	flows := map[uint16]int{}
+	for pkt := s.Next(); pkt != nil; pkt = s.Next() {
+		key, _ := FlowKeyOf(pkt)
+		flows[key.PortA]++
+	}
+	if len(flows) == 0 || len(flows) == 20 {
+		t.Fatalf("sampled %d of 20 flows", len(flows))
+	}
+	for port, n := range flows {
+		if n != 50 {
+			t.Fatalf("flow %d partially sampled: %d packets", port, n)
+		}
+	}
+}
+
+func TestSamplerRateLimit(t *testing.T) {
+	var src sliceSource
+	start := time.Unix(1000, 0)
+	// 100 packets over one second.
+	for i := 0; i < 100; i++ {
+		src = append(src, udpPacket(start.Add(time.Duration(i)*10*time.Millisecond), 1, 2, 1, 2, nil))
+	}
+	s := NewSampler(&src, SamplerConfig{PacketsPerSec: 10, Burst: time.Second})
+	n := 0
+	for pkt := s.Next(); pkt != nil; pkt = s.Next() {
+		n++
+	}
+	// Full bucket of 10 plus about 10 refilled during the second.
+	if n < 15 || n > 21 {
+		t.Fatalf("rate limiter passed %d packets", n)
+	}
+	if st := s.Stats(); st.RateLimited != uint64(100-n) {
+		t.Fatalf("stats %+v", st)
+	}
+}
@@ -0,0 +1,47 @@
+package pcap
+
+// PacketSource is a stream of packets. Pcap, Reader and the wrappers in
+// this package implement it, so wrappers can be stacked.
+//
+// Next returns nil when no packet is available: at the end of a file, or
+// when a live handle's read timeout expires.
+type PacketSource interface {
+	Next() *Packet
+}
+
+// PacketWriteCloser is an output for packets, such as a Writer or a
+// RotatingWriter.
+type PacketWriteCloser interface {
+	Write(pkt *Packet) error
+	Close() error
+}
+
+// Handle is the capture handle API shared by a local Pcap and a
+// RemoteClient. NextEx returns a positive result for a packet, 0 when the
+// read timeout expired, -1 on error, as told by Geterror, and -2 at the end
+// of the capture or after BreakLoop. An offline Pcap returns 0 at the end of
+// its file instead, as pcap_dispatch does; Capture handles both.
+type Handle interface {
+	PacketSource
+	NextEx(pktin *Packet) (*Packet, int32)
+	SetFilter(expr string) error
+	Getstats() (*Stat, error)
+	Datalink() int
+	Geterror() error
+	BreakLoop()
+	Close()
+}
+
+var _ Handle = (*Pcap)(nil)
+
+// packetLinkType returns the link type of the packets h delivers. A Pcap
+// delivers Ethernet or raw IP packets, see FindRawDataLinks.
+func packetLinkType(h Handle) int {
+	if p, ok := h.(*Pcap); ok {
+		if p.IsRaw {
+			return LINKTYPE_RAW
+		}
+		return LINKTYPE_ETHERNET
+	}
+	return h.Datalink()
+}
@@ -0,0 +1,236 @@
+package pcap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PacketRange selects packets First through Last, counting the packets of
+// the input from 1 like editcap. A zero Last means to the end.
+type PacketRange struct {
+	First, Last uint64
+}
+
+// SplitOptions selects the packets Split keeps and how it divides them.
+// Without Every, Interval or ByFlow all kept packets go to one output.
+type SplitOptions struct {
+	Start time.Time // keep packets at or after Start, if set
+	End   time.Time // keep packets before End, if set
+
+	Packets []PacketRange // keep only these packets, if set
+
+	Every    int           // start a new output every Every kept packets
+	Interval time.Duration // start a new output every Interval after the first kept packet
+
+	// ByFlow writes each conversation, as given by FlowKeyOf, to its own
+	// output. Packets without a flow key go to the output "other". Every
+	// and Interval do not apply.
+	ByFlow bool
+
+	// MaxOpen limits the outputs ByFlow keeps open, 256 if zero. Beyond
+	// it the least recently written output is closed, and reopened if its
+	// conversation continues.
+	MaxOpen int
+}
+
+// SplitStats counts the work of Split.
+type SplitStats struct {
+	Read    uint64 // packets read from the input
+	Written uint64 // packets written to outputs
+	Outputs int
+}
+
+// Split reads src and writes the packets selected by opts to outputs
+// opened with create. Outputs are named by their sequence number, from
+// "0", or for ByFlow by the conversation. create is called with reopen set
+// for an output ByFlow closed before, which must then be appended to. All
+// outputs are closed when Split returns.
+func Split(src PacketSource, opts SplitOptions, create func(name string, reopen bool) (PacketWriteCloser, error)) (SplitStats, error) {
+	var stats SplitStats
+	outs := make(map[string]PacketWriteCloser)
+	created := make(map[string]bool)
+	written := make(map[string]uint64) // ByFlow: packet last written to each open output
+	maxOpen := opts.MaxOpen
+	if maxOpen <= 0 {
+		maxOpen = 256
+	}
+	var cur PacketWriteCloser
+	var curCount int
+	var curStart time.Time
+	closeAll := func(err error) error {
+		for _, w := range outs {
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}
+	open := func(name string) (PacketWriteCloser, error) {
+		w, err := create(name, created[name])
+		if err != nil {
+			return nil, err
+		}
+		outs[name] = w
+		if !created[name] {
+			created[name] = true
+			stats.Outputs++
+		}
+		return w, nil
+	}
+	// closeIdle closes the least recently written ByFlow output.
+	closeIdle := func() error {
+		idle := ""
+		for name := range outs {
+			if idle == "" || written[name] < written[idle] {
+				idle = name
+			}
+		}
+		w := outs[idle]
+		delete(outs, idle)
+		delete(written, idle)
+		return w.Close()
+	}
+
+	lastWanted := lastPacket(opts.Packets)
+	for lastWanted == 0 || stats.Read < lastWanted {
+		pkt := src.Next()
+		if pkt == nil {
+			break
+		}
+		stats.Read++
+		if !opts.keep(pkt, stats.Read) {
+			continue
+		}
+
+		var w PacketWriteCloser
+		var err error
+		if opts.ByFlow {
+			name := "other"
+			if key, ok := FlowKeyOf(pkt); ok {
+				name = flowName(key)
+			}
+			if w = outs[name]; w == nil {
+				if len(outs) >= maxOpen {
+					err = closeIdle()
+				}
+				if err == nil {
+					w, err = open(name)
+				}
+			}
+			written[name] = stats.Read
+		} else {
+			if cur != nil && (opts.Every > 0 && curCount >= opts.Every ||
+				opts.Interval > 0 && pkt.Time.Sub(curStart) >= opts.Interval) {
+				err = cur.Close()
+				delete(outs, strconv.Itoa(stats.Outputs-1))
+				cur = nil
+			}
+			if cur == nil && err == nil {
+				if cur, err = open(strconv.Itoa(stats.Outputs)); err == nil {
+					curCount = 0
+					if opts.Interval > 0 {
+						// Outputs cover whole intervals from the first packet.
+						if curStart.IsZero() {
+							curStart = pkt.Time
+						}
+						for pkt.Time.Sub(curStart) >= opts.Interval {
+							curStart = curStart.Add(opts.Interval)
+						}
+					}
+				}
+			}
+			w = cur
+		}
+		if err != nil {
+			return stats, closeAll(err)
+		}
+		if err := w.Write(pkt); err != nil {
+			return stats, closeAll(err)
+		}
+		curCount++
+		stats.Written++
+	}
+	if e, ok := src.(interface{ Err() error }); ok && e.Err() != nil {
+		return stats, closeAll(e.Err())
+	}
+	return stats, closeAll(nil)
+}
+
+// SplitFiles returns a create function for Split that writes each output
+// to the pcap file prefix+"-"+name+".pcap" with header and opts. Files that
+// exist already are not overwritten.
+func SplitFiles(prefix string, header *FileHeader, opts WriterOptions) func(name string, reopen bool) (PacketWriteCloser, error) {
+	return func(name string, reopen bool) (PacketWriteCloser, error) {
+		o := opts
+		o.Append = reopen
+		f, err := createWriterFile(prefix+"-"+name+".pcap", header, o)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+}
+
+func (o *SplitOptions) keep(pkt *Packet, n uint64) bool {
+	if !o.Start.IsZero() && pkt.Time.Before(o.Start) {
+		return false
+	}
+	if !o.End.IsZero() && !pkt.Time.Before(o.End) {
+		return false
+	}
+	if len(o.Packets) == 0 {
+		return true
+	}
+	for _, r := range o.Packets {
+		if n >= r.First && (r.Last == 0 || n <= r.Last) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastPacket returns the last packet number the ranges select, or 0 if
+// they are open-ended or empty.
+func lastPacket(ranges []PacketRange) uint64 {
+	var last uint64
+	for _, r := range ranges {
+		if r.Last == 0 {
+			return 0
+		}
+		if r.Last > last {
+			last = r.Last
+		}
+	}
+	return last
+}
+
+// ParsePacketRanges parses a list like "1-100,250,300-" into ranges.
+func ParsePacketRanges(s string) ([]PacketRange, error) {
+	var ranges []PacketRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		first, last, isRange := strings.Cut(part, "-")
+		var r PacketRange
+		var err error
+		if r.First, err = strconv.ParseUint(first, 10, 64); err != nil || r.First == 0 {
+			return nil, fmt.Errorf("pcap: bad packet range %q", part)
+		}
+		switch {
+		case !isRange:
+			r.Last = r.First
+		case last != "":
+			if r.Last, err = strconv.ParseUint(last, 10, 64); err != nil || r.Last < r.First {
+				return nil, fmt.Errorf("pcap: bad packet range %q", part)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// flowName turns a flow key into an output name usable in a file name.
+func flowName(key FlowKey) string {
+	return strings.NewReplacer(" ", "_", ":", "_", "-", "_").Replace(key.String())
+}
@@ -0,0 +1,198 @@
+package pcap
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// splitSink collects the source ports of the packets written to each
+// output.
+type splitSink struct {
+	ports  map[string][]int
+	closed map[string]bool
+}
+
+type splitOutput struct {
+	s    *splitSink
+	name string
+}
+
+func (o splitOutput) Write(pkt *Packet) error {
+	key, _ := FlowKeyOf(pkt)
+	o.s.ports[o.name] = append(o.s.ports[o.name], int(key.PortA))
+	return nil
+}
+
+func (o splitOutput) Close() error {
+	o.s.closed[o.name] = true
+	return nil
+}
+
+func runSplit(t *testing.T, opts SplitOptions) map[string][]int {
+	// Ports 1 to 8 at seconds 0, 1, 2, 3, 10, 11, 12, 13.
+	data := mergeInput(LINKTYPE_ETHERNET, []uint16{1, 2, 3, 4, 5, 6, 7, 8}, []int{0, 1, 2, 3, 10, 11, 12, 13})
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &splitSink{ports: make(map[string][]int), closed: make(map[string]bool)}
+	stats, err := Split(r, opts, func(name string, reopen bool) (PacketWriteCloser, error) {
+		if reopen != s.closed[name] || !reopen && s.ports[name] != nil {
+			t.Fatalf("output %q opened again, reopen %v", name, reopen)
+		}
+		s.closed[name] = false
+		return splitOutput{s, name}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Outputs != len(s.closed) {
+		t.Errorf("%d outputs, %d closed", stats.Outputs, len(s.closed))
+	}
+	return s.ports
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		opts SplitOptions
+		want map[string][]int
+	}{
+		{"all", SplitOptions{}, map[string][]int{"0": {1, 2, 3, 4, 5, 6, 7, 8}}},
+		{"time", SplitOptions{Start: time.Unix(2, 0), End: time.Unix(11, 0)},
+			map[string][]int{"0": {3, 4, 5}}},
+		{"packets", SplitOptions{Packets: []PacketRange{{2, 3}, {7, 7}}},
+			map[string][]int{"0": {2, 3, 7}}},
+		{"every", SplitOptions{Every: 3}, map[string][]int{"0": {1, 2, 3}, "1": {4, 5, 6}, "2": {7, 8}}},
+		{"interval", SplitOptions{Interval: 3 * time.Second},
+			map[string][]int{"0": {1, 2, 3}, "1": {4}, "2": {5, 6}, "3": {7, 8}}},
+		{"every in range", SplitOptions{Start: time.Unix(1, 0), Packets: []PacketRange{{1, 6}}, Every: 2},
+			map[string][]int{"0": {2, 3}, "1": {4, 5}, "2": {6}}},
+	}
+	for _, tt := range tests {
+		got := runSplit(t, tt.opts)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got outputs %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for name, ports := range tt.want {
+			if !equalInts(got[name], ports) {
+				t.Errorf("%s: output %s got %v, want %v", tt.name, name, got[name], ports)
+			}
+		}
+	}
+}
+
+func TestSplitByFlow(t *testing.T) {
+	got := runSplit(t, SplitOptions{ByFlow: true, Every: 1})
+	if len(got) != 8 {
+		t.Fatalf("got %d flows, want 8", len(got))
+	}
+	for name, ports := range got {
+		if len(ports) != 1 {
+			t.Errorf("flow %s got %v", name, ports)
+		}
+	}
+}
+
+func TestSplitFiles(t *testing.T) {
+	dir := t.TempDir()
+	data := mergeInput(LINKTYPE_ETHERNET, []uint16{1, 2, 3}, []int{0, 1, 2})
+	r, _ := NewReader(bytes.NewReader(data))
+	create := SplitFiles(filepath.Join(dir, "split"), &r.Header, WriterOptions{})
+	if _, err := Split(r, SplitOptions{Every: 2}, create); err != nil {
+		t.Fatal(err)
+	}
+	checkSplitFiles(t, dir, map[string]int{"split-0": 2, "split-1": 1})
+
+	r, _ = NewReader(bytes.NewReader(data))
+	if _, err := Split(r, SplitOptions{}, create); err == nil {
+		t.Fatal("existing output overwritten")
+	}
+	r, _ = NewReader(bytes.NewReader(data))
+	stats, err := Split(r, SplitOptions{Packets: []PacketRange{{1, 2}}}, func(string, bool) (PacketWriteCloser, error) {
+		return splitOutput{&splitSink{ports: map[string][]int{}, closed: map[string]bool{}}, "0"}, nil
+	})
+	if err != nil || stats.Read != 2 || stats.Written != 2 {
+		t.Fatalf("stats %+v err %v", stats, err)
+	}
+}
+
+func TestSplitMaxOpen(t *testing.T) {
+	dir := t.TempDir()
+	data := mergeInput(LINKTYPE_ETHERNET, []uint16{1, 2, 3, 1, 2, 3, 1}, []int{0, 1, 2, 3, 4, 5, 6})
+	r, _ := NewReader(bytes.NewReader(data))
+	open := 0
+	stats, err := Split(r, SplitOptions{ByFlow: true, MaxOpen: 2}, func(name string, reopen bool) (PacketWriteCloser, error) {
+		w, err := createWriterFile(filepath.Join(dir, name+".pcap"), &r.Header, WriterOptions{Append: reopen})
+		if err != nil {
+			return nil, err
+		}
+		if open++; open > 2 {
+			t.Fatalf("%d outputs open", open)
+		}
+		return closeFunc{w, func() { open-- }}, nil
+	})
+	if err != nil || stats.Outputs != 3 || stats.Written != 7 {
+		t.Fatalf("stats %+v err %v", stats, err)
+	}
+	key, _ := FlowKeyOf(udpPacket(time.Unix(0, 0), 1, 2, 1, 53, nil))
+	checkSplitFiles(t, dir, map[string]int{flowName(key): 3})
+}
+
+// closeFunc calls done when the output is closed.
+type closeFunc struct {
+	PacketWriteCloser
+	done func()
+}
+
+func (c closeFunc) Close() error {
+	c.done()
+	return c.PacketWriteCloser.Close()
+}
+
+// checkSplitFiles checks the number of packets in the named files of dir.
+func checkSplitFiles(t *testing.T, dir string, counts map[string]int) {
+	for name, want := range counts {
+		f, err := os.Open(filepath.Join(dir, name+".pcap"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fr, err := NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for fr.Next() != nil {
+			n++
+		}
+		f.Close()
+		if n != want || fr.Err() != nil {
+			t.Errorf("%s: %d packets, want %d, err %v", name, n, want, fr.Err())
+		}
+	}
+}
+
+func TestParsePacketRanges(t *testing.T) {
+	got, err := ParsePacketRanges("1-100, 250,300-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PacketRange{{1, 100}, {250, 250}, {300, 0}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	for _, bad := range []string{"", "0", "5-2", "x", "1-y"} {
+		if _, err := ParsePacketRanges(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
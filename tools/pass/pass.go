@@ -35,7 +35,7 @@ func copyPcap(dest, src string) {
 	}
 	defer w.Close()
 	buf := bufio.NewWriter(w)
-	writer, err := pcap.NewWriter(buf, &reader.Header)
+	writer, err := pcap.NewWriterOptions(buf, &reader.Header, pcap.WriterOptions{BigEndian: reader.BigEndian()})
 	if err != nil {
 		fmt.Printf("couldn't create writer: %v\n", err)
 		return
@@ -51,7 +51,12 @@ func copyPcap(dest, src string) {
 		}
 		writer.Write(pkt)
 	}
-	buf.Flush()
+	if err := reader.Err(); err != nil {
+		fmt.Printf("couldn't read %q: %v\n", src, err)
+	}
+	if err := writer.Close(); err != nil {
+		fmt.Printf("couldn't write %q: %v\n", dest, err)
+	}
 }
 
 func check(dest, src string) {
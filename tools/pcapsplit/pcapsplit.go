@@ -0,0 +1,69 @@
+package main
+
+// Slices and splits a pcap file by time, packet number, count, interval
+// or conversation, like editcap.
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lacework/pcap"
+)
+
+var input *string = flag.String("r", "", "input file")
+var prefix *string = flag.String("w", "split", "output file prefix")
+var start *string = flag.String("start", "", "keep packets at or after this RFC3339 time")
+var end *string = flag.String("end", "", "keep packets before this RFC3339 time")
+var packets *string = flag.String("p", "", "keep these packet numbers, e.g. 1-100,250,300-")
+var every *int = flag.Int("c", 0, "start a new file every this many packets")
+var interval *time.Duration = flag.Duration("i", 0, "start a new file every this interval")
+var flows *bool = flag.Bool("flows", false, "write one file per conversation")
+var maxOpen *int = flag.Int("maxopen", 256, "with -flows, keep at most this many files open")
+
+func main() {
+	flag.Parse()
+	if *input == "" {
+		fmt.Fprintln(os.Stderr, "usage: pcapsplit -r input [-w prefix] [options]")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	opts := pcap.SplitOptions{Every: *every, Interval: *interval, ByFlow: *flows, MaxOpen: *maxOpen}
+	var err error
+	if *start != "" {
+		if opts.Start, err = time.Parse(time.RFC3339Nano, *start); err != nil {
+			fatal(err)
+		}
+	}
+	if *end != "" {
+		if opts.End, err = time.Parse(time.RFC3339Nano, *end); err != nil {
+			fatal(err)
+		}
+	}
+	if *packets != "" {
+		if opts.Packets, err = pcap.ParsePacketRanges(*packets); err != nil {
+			fatal(err)
+		}
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		fatal(err)
+	}
+	defer f.Close()
+	reader, err := pcap.NewReader(bufio.NewReader(f))
+	if err != nil {
+		fatal(err)
+	}
+	stats, err := pcap.Split(reader, opts, pcap.SplitFiles(*prefix, &reader.Header, pcap.WriterOptions{BigEndian: reader.BigEndian()}))
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("read %d packets, wrote %d to %d files\n", stats.Read, stats.Written, stats.Outputs)
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "pcapsplit: %v\n", err)
+	os.Exit(1)
+}
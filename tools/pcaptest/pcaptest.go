@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"time"
@@ -19,6 +20,9 @@ func main() {
 	var device *string = flag.String("d", "", "device")
 	var file *string = flag.String("r", "", "file")
 	var expr *string = flag.String("e", "", "filter expression")
+	var count *int = flag.Int("c", 0, "stop after this many packets")
+	var duration *time.Duration = flag.Duration("t", 0, "stop after this long")
+	var idle *time.Duration = flag.Duration("idle", 0, "stop when no packet arrives for this long")
 
 	flag.Parse()
 
@@ -71,7 +75,8 @@ func main() {
 		}
 	}
 
-	for pkt := h.Next(); pkt != nil; pkt = h.Next() {
+	limits := pcap.Limits{Packets: uint64(*count), Duration: *duration, Idle: *idle}
+	sum, err := pcap.Capture(context.Background(), h, limits, func(pkt *pcap.Packet) error {
 		fmt.Printf("time: %d.%06d (%s) caplen: %d len: %d\nData:",
 			int64(pkt.Time.Second()), int64(pkt.Time.Nanosecond()),
 			time.Unix(int64(pkt.Time.Second()), 0).String(), int64(pkt.Caplen), int64(pkt.Len))
@@ -86,6 +91,11 @@ func main() {
 			}
 		}
 		fmt.Printf("\n\n")
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Warning: capture failed: %s\n", err)
 	}
-
+	fmt.Printf("%d packets, %d bytes, first %s, last %s, stopped on %s\n",
+		sum.Packets, sum.Bytes, sum.First, sum.Last, sum.Reason)
 }
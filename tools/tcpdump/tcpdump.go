@@ -72,27 +72,34 @@ func main() {
 		}
 	}
 
-	/*
-		if *ofile != "" {
-			dumper, oerr := h.DumpOpen(ofile)
-			addHandler(h, dumper)
-			if oerr != nil {
-				fmt.Fprintln(os.Stderr, "tcpdump: couldn't write to file:", oerr)
-			}
-			_, lerr := h.PcapLoop(0, dumper)
-			if lerr != nil {
-				fmt.Fprintln(os.Stderr, "tcpdump: loop error:", lerr, h.Geterror())
-			}
-			defer h.PcapDumpClose(dumper)
+	var dumper *pcap.PcapDumper
+	if *ofile != "" {
+		var oerr error
+		dumper, oerr = h.DumpOpen(ofile)
+		if oerr != nil {
+			fmt.Fprintln(os.Stderr, "tcpdump: couldn't write to file:", oerr)
 			return
 		}
-	*/
+		defer func() {
+			if cerr := dumper.Close(); cerr != nil {
+				fmt.Fprintln(os.Stderr, "tcpdump: couldn't write to file:", cerr)
+			}
+		}()
+		addHandler(h)
+	}
 
-	for pkt, r := h.NextEx(nil); r >= 0; pkt, r = h.NextEx(nil) {
+	for pkt, r := h.NextEx(nil); r >= 0; pkt, r = h.NextEx(pkt) {
 		if r == 0 {
 			// timeout, continue
 			continue
 		}
+		if dumper != nil {
+			if werr := dumper.WritePacket(pkt); werr != nil {
+				fmt.Fprintln(os.Stderr, "tcpdump: couldn't write to file:", werr)
+				return
+			}
+			continue
+		}
 		pkt.Decode()
 		fmt.Println(pkt)
 		if *hexdump {
@@ -103,18 +110,15 @@ func main() {
 
 }
 
-func addHandler(h *pcap.Pcap, dumper *pcap.PcapDumper) {
+// addHandler stops the capture loop on an interrupt, so the dump file is
+// flushed and closed.
+func addHandler(h pcap.Handle) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
-		for sig := range c {
-			fmt.Fprintln(os.Stderr, "tcpdump: received signal:", sig)
-			if os.Interrupt == sig {
-				h.PcapDumpClose(dumper)
-				h.Close()
-				os.Exit(1)
-			}
-		}
+		sig := <-c
+		fmt.Fprintln(os.Stderr, "tcpdump: received signal:", sig)
+		h.BreakLoop()
 	}()
 }
 